@@ -2,9 +2,15 @@ package main
 
 import (
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -43,59 +49,292 @@ func (e SerializerError) Error() string {
 	return fmt.Sprintf("Serializer error: got %v", e.err)
 }
 
+// Mesg is a cache entry. Msg is owned by the cache and never modified once
+// stored, readers get their own copy of it.
 type Mesg struct {
 	Msg    *dns.Msg
+	Stored time.Time
 	Expire time.Time
+
+	size int64
+}
+
+// Rough per entry overhead of the memory cache: the map slot, Mesg and
+// the bookkeeping of the eviction policy.
+const entryOverhead = 128
+
+// entrySize approximates the memory held by a cache entry, counting the
+// response at its wire size.
+func entrySize(key string, mesg Mesg) int64 {
+	n := len(key) + entryOverhead
+	if mesg.Msg != nil {
+		n += mesg.Msg.Len()
+	}
+	return int64(n)
 }
 
+// Get returns the cached response, with TTLs already decremented by the
+// time spent in cache. Set stores msg for ttl. Caches created with a stale
+// window keep entries that long past their ttl, Get returns them along with
+// a KeyExpired error so they can be served stale (RFC 8767). Flush drops
+// the entries selected by filter.
 type Cache interface {
 	Get(key string) (Msg *dns.Msg, err error)
-	Set(key string, Msg *dns.Msg) error
+	Set(key string, Msg *dns.Msg, ttl time.Duration) error
 	Exists(key string) bool
 	Remove(key string) error
+	Flush(filter CacheFilter) error
 	Full() bool
+	Stats() CacheStats
+}
+
+// CacheStats are the counters of a cache. Hits and Misses count Get calls,
+// stale entries counting as misses. Remote backends only know about the
+// calls of this instance, and leave what they can't tell at zero.
+type CacheStats struct {
+	Hits           uint64 `json:"hits"`
+	Misses         uint64 `json:"misses"`
+	Expired        uint64 `json:"expired"`
+	Evicted        uint64 `json:"evicted"`
+	FullRejections uint64 `json:"full_rejections"`
+	Entries        int    `json:"entries"`
+	Bytes          int64  `json:"bytes"`
+}
+
+func (s *CacheStats) add(o CacheStats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Expired += o.Expired
+	s.Evicted += o.Evicted
+	s.FullRejections += o.FullRejections
+	s.Entries += o.Entries
+	s.Bytes += o.Bytes
+}
+
+// getCounters counts the hits and misses of the remote backends.
+type getCounters struct {
+	hits   uint64
+	misses uint64
+}
+
+func (c *getCounters) count(err error) {
+	if err == nil {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *getCounters) stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// CacheFilter selects cache entries by the question they were cached for.
+// The zero CacheFilter selects every entry. Name is matched without the
+// trailing dot, in lower case, and with Suffix, so are its subdomains.
+// Type, if set, only selects that query type, e.g. "AAAA".
+type CacheFilter struct {
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Suffix bool   `json:"suffix,omitempty"`
+}
+
+// Match tells whether filter selects the entry stored under key.
+func (filter CacheFilter) Match(key string) bool {
+	if filter.Name == "" && filter.Type == "" {
+		return true
+	}
+	// see KeyGen for the layout of keys
+	fields := strings.SplitN(key, " ", 4)
+	if len(fields) < 3 {
+		return false
+	}
+	if filter.Type != "" && fields[2] != filter.Type {
+		return false
+	}
+	qname := fields[0]
+	switch {
+	case filter.Name == "" || qname == filter.Name:
+		return true
+	case filter.Suffix:
+		return strings.HasSuffix(qname, "."+filter.Name)
+	}
+	return false
+}
+
+// NewMemoryCache returns a cache holding at most maxcount entries and
+// maxBytes bytes, see entrySize, evicting according to policy ("lru", "lfu"
+// or "arc") once full. Zero leaves the cache unbounded in that dimension.
+// Entries are kept for stale past their expiry, and swept every
+// sweepInterval after that. A zero interval leaves them until they are
+// next read.
+func NewMemoryCache(maxcount int, maxBytes int64, policy string, sweepInterval, stale time.Duration) (*MemoryCache, error) {
+	c := &MemoryCache{
+		Backend:  make(map[string]Mesg, maxcount),
+		Maxcount: maxcount,
+		maxBytes: maxBytes,
+		stale:    stale,
+	}
+	capacity := maxcount
+	if capacity == 0 && maxBytes > 0 {
+		// no entry is smaller than entryOverhead, so the count bound
+		// never kicks in before the bytes one
+		capacity = int(maxBytes / entryOverhead)
+	}
+	if capacity > 0 {
+		p, err := newEvictionPolicy(policy, capacity)
+		if err != nil {
+			return nil, err
+		}
+		c.policy = p
+	}
+	if sweepInterval > 0 {
+		go c.sweeper(sweepInterval)
+	}
+	return c, nil
 }
 
 type MemoryCache struct {
+	// accessed atomically, keep them first for 64-bit alignment
+	evicted  uint64
+	expired  uint64
+	hits     uint64
+	misses   uint64
+	rejected uint64
+
 	Backend  map[string]Mesg
-	Expire   time.Duration
+	bytes    int64
+	maxBytes int64
 	Maxcount int
+	policy   evictionPolicy
+	stale    time.Duration
 	mu       sync.RWMutex
+	// policyMu guards policy, so that hits only need mu for reading. It is
+	// taken after mu when both are.
+	policyMu sync.Mutex
 }
 
 func (c *MemoryCache) Get(key string) (*dns.Msg, error) {
+	msg, _, err := c.GetExpire(key)
+	if err == nil {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return msg, err
+}
+
+func (c *MemoryCache) GetExpire(key string) (*dns.Msg, time.Time, error) {
 	c.mu.RLock()
 	mesg, ok := c.Backend[key]
 	c.mu.RUnlock()
+	if ok && c.policy != nil {
+		// a no-op if the key was removed in between
+		c.policyMu.Lock()
+		c.policy.Access(key)
+		c.policyMu.Unlock()
+	}
 	if !ok {
-		return nil, KeyNotFound{key}
+		return nil, time.Time{}, KeyNotFound{key}
 	}
 
-	if mesg.Expire.Before(time.Now()) {
+	now := time.Now()
+	if mesg.Expire.Add(c.stale).Before(now) {
 		c.Remove(key)
-		return nil, KeyExpired{key}
+		atomic.AddUint64(&c.expired, 1)
+		return nil, mesg.Expire, KeyExpired{key}
 	}
 
-	return mesg.Msg, nil
-
+	if mesg.Msg == nil {
+		return nil, mesg.Expire, nil
+	}
+	msg := ageMsg(mesg.Msg, now.Sub(mesg.Stored))
+	if mesg.Expire.Before(now) {
+		return msg, mesg.Expire, KeyExpired{key}
+	}
+	return msg, mesg.Expire, nil
 }
 
-func (c *MemoryCache) Set(key string, msg *dns.Msg) error {
-	if c.Full() && !c.Exists(key) {
-		return CacheIsFull{}
+// Set stores a copy of msg, so that the caller may keep using it.
+func (c *MemoryCache) Set(key string, msg *dns.Msg, ttl time.Duration) error {
+	if msg != nil {
+		msg = msg.Copy()
 	}
+	now := time.Now()
+	return c.put(key, Mesg{Msg: msg, Stored: now, Expire: now.Add(ttl)})
+}
+
+// put stores mesg as is, evicting entries if the cache is full.
+func (c *MemoryCache) put(key string, mesg Mesg) error {
+	mesg.size = entrySize(key, mesg)
 
-	expire := time.Now().Add(c.Expire)
-	mesg := Mesg{msg, expire}
 	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.policy != nil {
+		c.policyMu.Lock()
+		defer c.policyMu.Unlock()
+	}
+
+	if c.maxBytes > 0 && mesg.size > c.maxBytes {
+		atomic.AddUint64(&c.rejected, 1)
+		return CacheIsFull{}
+	}
+	if c.policy == nil {
+		if _, ok := c.Backend[key]; !ok && c.Maxcount > 0 && len(c.Backend) >= c.Maxcount {
+			atomic.AddUint64(&c.rejected, 1)
+			return CacheIsFull{}
+		}
+	} else {
+		// Make room before the policy learns about key, so that it can't
+		// pick the entry being stored. It may pick the one being replaced.
+		for c.maxBytes > 0 && c.bytes-c.Backend[key].size+mesg.size > c.maxBytes {
+			victim, ok := c.policy.Evict()
+			if !ok {
+				break
+			}
+			c.bytes -= c.Backend[victim].size
+			delete(c.Backend, victim)
+			atomic.AddUint64(&c.evicted, 1)
+		}
+		if victim, evicted := c.policy.Add(key); evicted {
+			c.bytes -= c.Backend[victim].size
+			delete(c.Backend, victim)
+			atomic.AddUint64(&c.evicted, 1)
+		}
+	}
+	c.bytes += mesg.size - c.Backend[key].size
 	c.Backend[key] = mesg
-	c.mu.Unlock()
 	return nil
 }
 
 func (c *MemoryCache) Remove(key string) error {
 	c.mu.Lock()
+	c.remove(key)
+	c.mu.Unlock()
+	return nil
+}
+
+// remove must be called with c.mu held, and c.policyMu not.
+func (c *MemoryCache) remove(key string) {
+	c.bytes -= c.Backend[key].size
 	delete(c.Backend, key)
+	if c.policy != nil {
+		c.policyMu.Lock()
+		c.policy.Remove(key)
+		c.policyMu.Unlock()
+	}
+}
+
+func (c *MemoryCache) Flush(filter CacheFilter) error {
+	c.mu.Lock()
+	for key := range c.Backend {
+		if filter.Match(key) {
+			c.remove(key)
+		}
+	}
 	c.mu.Unlock()
 	return nil
 }
@@ -114,70 +353,466 @@ func (c *MemoryCache) Length() int {
 }
 
 func (c *MemoryCache) Full() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.maxBytes > 0 && c.bytes >= c.maxBytes {
+		return true
+	}
 	// if Maxcount is zero. the cache will never be full.
 	if c.Maxcount == 0 {
 		return false
 	}
-	return c.Length() >= c.Maxcount
+	return len(c.Backend) >= c.Maxcount
+}
+
+// Evicted returns the number of entries evicted to make room for new ones.
+func (c *MemoryCache) Evicted() uint64 {
+	return atomic.LoadUint64(&c.evicted)
+}
+
+// Expired returns the number of entries dropped because they expired.
+func (c *MemoryCache) Expired() uint64 {
+	return atomic.LoadUint64(&c.expired)
+}
+
+func (c *MemoryCache) Stats() CacheStats {
+	c.mu.RLock()
+	entries, bytes := len(c.Backend), c.bytes
+	c.mu.RUnlock()
+	return CacheStats{
+		Hits:           atomic.LoadUint64(&c.hits),
+		Misses:         atomic.LoadUint64(&c.misses),
+		Expired:        atomic.LoadUint64(&c.expired),
+		Evicted:        atomic.LoadUint64(&c.evicted),
+		FullRejections: atomic.LoadUint64(&c.rejected),
+		Entries:        entries,
+		Bytes:          bytes,
+	}
+}
+
+// Sweep drops every expired entry and returns how many were dropped.
+func (c *MemoryCache) Sweep() int {
+	now := time.Now()
+	n := 0
+
+	c.mu.Lock()
+	for key, mesg := range c.Backend {
+		if mesg.Expire.Add(c.stale).Before(now) {
+			c.remove(key)
+			n++
+		}
+	}
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.expired, uint64(n))
+	return n
+}
+
+func (c *MemoryCache) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if n := c.Sweep(); n > 0 {
+			logger.Debug("Sweep %d expired cache entries, %d left, %d evicted so far", n, c.Length(), c.Evicted())
+		}
+	}
+}
+
+/*
+Sharded memory backend
+*/
+
+// NewShardedCache spreads keys over n MemoryCache shards by hash, so that
+// concurrent lookups of different names don't contend on a single lock.
+// maxcount and maxBytes are split evenly between the shards.
+func NewShardedCache(n int, maxcount int, maxBytes int64, policy string, sweepInterval, stale time.Duration) (*ShardedCache, error) {
+	perShard := 0
+	if maxcount > 0 {
+		perShard = (maxcount + n - 1) / n
+	}
+	bytesPerShard := maxBytes / int64(n)
+	if maxBytes > 0 && bytesPerShard == 0 {
+		bytesPerShard = 1
+	}
+
+	c := &ShardedCache{shards: make([]*MemoryCache, n)}
+	for i := range c.shards {
+		shard, err := NewMemoryCache(perShard, bytesPerShard, policy, sweepInterval, stale)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = shard
+	}
+	return c, nil
+}
+
+type ShardedCache struct {
+	shards []*MemoryCache
+}
+
+func (c *ShardedCache) shard(key string) *MemoryCache {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *ShardedCache) Get(key string) (*dns.Msg, error) {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedCache) Set(key string, msg *dns.Msg, ttl time.Duration) error {
+	return c.shard(key).Set(key, msg, ttl)
+}
+
+func (c *ShardedCache) Exists(key string) bool {
+	return c.shard(key).Exists(key)
+}
+
+func (c *ShardedCache) Remove(key string) error {
+	return c.shard(key).Remove(key)
+}
+
+func (c *ShardedCache) Flush(filter CacheFilter) error {
+	for _, shard := range c.shards {
+		shard.Flush(filter)
+	}
+	return nil
+}
+
+// Full reports whether every shard is full. Shards evict on their own, so
+// a single full shard doesn't keep new entries out of the others.
+func (c *ShardedCache) Full() bool {
+	for _, shard := range c.shards {
+		if !shard.Full() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *ShardedCache) Length() int {
+	n := 0
+	for _, shard := range c.shards {
+		n += shard.Length()
+	}
+	return n
+}
+
+func (c *ShardedCache) Evicted() uint64 {
+	var n uint64
+	for _, shard := range c.shards {
+		n += shard.Evicted()
+	}
+	return n
+}
+
+func (c *ShardedCache) Expired() uint64 {
+	var n uint64
+	for _, shard := range c.shards {
+		n += shard.Expired()
+	}
+	return n
+}
+
+func (c *ShardedCache) Stats() CacheStats {
+	var stats CacheStats
+	for _, shard := range c.shards {
+		stats.add(shard.Stats())
+	}
+	return stats
+}
+
+func (c *ShardedCache) Sweep() int {
+	n := 0
+	for _, shard := range c.shards {
+		n += shard.Sweep()
+	}
+	return n
+}
+
+/*
+Tiered backend
+*/
+
+// ExpiringCache is a Cache that can tell when its entries expire, which
+// lets TieredCache keep its local tier consistent with the shared one.
+type ExpiringCache interface {
+	Cache
+	GetExpire(key string) (Msg *dns.Msg, expire time.Time, err error)
+}
+
+// NewTieredCache returns a cache reading through the local l1 to the
+// shared l2, and writing through to both.
+func NewTieredCache(l1 Cache, l2 ExpiringCache) *TieredCache {
+	return &TieredCache{L1: l1, L2: l2}
+}
+
+type TieredCache struct {
+	// accessed atomically, keep it first for 64-bit alignment
+	counters getCounters
+
+	L1 Cache
+	L2 ExpiringCache
+}
+
+func (c *TieredCache) Get(key string) (*dns.Msg, error) {
+	msg, err := c.get(key)
+	c.counters.count(err)
+	return msg, err
+}
+
+func (c *TieredCache) get(key string) (*dns.Msg, error) {
+	msg, err := c.L1.Get(key)
+	if err == nil {
+		return msg, nil
+	}
+	// The local entry is missing or stale, another instance may have
+	// refreshed the shared one.
+	stale := msg
+
+	msg, expire, err := c.L2.GetExpire(key)
+	if err != nil {
+		if stale != nil {
+			return stale, KeyExpired{key}
+		}
+		// which may still be a stale entry of the shared tier
+		return msg, err
+	}
+
+	// Only keep it locally for as long as the shared tier does.
+	if ttl := time.Until(expire); ttl > 0 {
+		if err := c.L1.Set(key, msg, ttl); err != nil {
+			logger.Warn("Set %s into local cache tier failed: %s", key, err)
+		}
+	}
+	return msg, nil
+}
+
+// Set writes both tiers. The local one is written even if the shared one
+// is unreachable, so that an outage of the latter doesn't turn caching off.
+func (c *TieredCache) Set(key string, msg *dns.Msg, ttl time.Duration) error {
+	if err := c.L2.Set(key, msg, ttl); err != nil {
+		logger.Warn("Set %s into shared cache tier failed: %s", key, err)
+	}
+	return c.L1.Set(key, msg, ttl)
+}
+
+func (c *TieredCache) Exists(key string) bool {
+	return c.L1.Exists(key) || c.L2.Exists(key)
+}
+
+func (c *TieredCache) Remove(key string) error {
+	c.L1.Remove(key)
+	return c.L2.Remove(key)
+}
+
+func (c *TieredCache) Flush(filter CacheFilter) error {
+	c.L1.Flush(filter)
+	return c.L2.Flush(filter)
+}
+
+// Stats counts the hits of either tier, and the entries of the local one.
+func (c *TieredCache) Stats() CacheStats {
+	stats := c.L1.Stats()
+	counters := c.counters.stats()
+	stats.Hits, stats.Misses = counters.Hits, counters.Misses
+	return stats
+}
+
+func (c *TieredCache) Full() bool {
+	// the local tier evicts, only the shared one can refuse entries
+	return c.L2.Full()
 }
 
 /*
 Memcached backend
 */
 
-func NewMemcachedCache(servers []string, expire int32) *MemcachedCache {
+// NewMemcachedCache returns a cache whose keys are stored under prefix, so
+// that several caches can share the same memcached servers. Entries are
+// kept for stale past their expiry.
+//
+// Memcached can't list its keys, so entries are stored under a generation
+// number, itself kept in memcached, and flushing moves every godns
+// instance on to the next generation, leaving the old entries to expire.
+func NewMemcachedCache(servers []string, prefix string, stale time.Duration) *MemcachedCache {
 	c := memcache.New(servers...)
 	return &MemcachedCache{
 		backend: c,
-		expire:  expire,
+		prefix:  prefix,
+		stale:   stale,
 	}
 }
 
 type MemcachedCache struct {
+	// accessed atomically, keep them first for 64-bit alignment
+	counters   getCounters
+	refreshing int32
+
 	backend *memcache.Client
-	expire  int32
+	prefix  string
+	stale   time.Duration
+
+	// generation holds a memcachedGeneration. mu only orders its updates,
+	// it is never held across a memcached round trip.
+	generation atomic.Value
+	mu         sync.Mutex
 }
 
-func (m *MemcachedCache) Set(key string, msg *dns.Msg) error {
-	var val []byte
-	var err error
+type memcachedGeneration struct {
+	value   uint64
+	checked time.Time
+}
 
-	// handle cases for negacache where it sets nil values
-	if msg == nil {
-		val = []byte("nil")
-	} else {
-		val, err = msg.Pack()
+// How long a memcached cache trusts its generation number before checking
+// whether another instance flushed the cache.
+const memcachedGenerationTTL = time.Second
+
+// The variants KeyGen may give a question, which an exact flush deletes.
+// Answers scoped to a client subnet can't be listed and are left to expire.
+var memcachedFlushVariants = []string{"", "do", "cd", "do cd"}
+
+// key returns the memcached key of key, which must be hashed as memcached
+// keys are short and can't contain spaces.
+func (m *MemcachedCache) key(key string) string {
+	return fmt.Sprintf("%s%d:%x", m.prefix, m.currentGeneration(), md5.Sum([]byte(key)))
+}
+
+// currentGeneration returns the generation number, checking it again in
+// the background once it is older than memcachedGenerationTTL. Only the
+// first call waits for memcached.
+func (m *MemcachedCache) currentGeneration() uint64 {
+	g, ok := m.generation.Load().(memcachedGeneration)
+	if !ok {
+		return m.refreshGeneration()
 	}
-	if err != nil {
-		err = SerializerError{err}
+	if time.Since(g.checked) >= memcachedGenerationTTL && atomic.CompareAndSwapInt32(&m.refreshing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&m.refreshing, 0)
+			m.refreshGeneration()
+		}()
 	}
-	return m.backend.Set(&memcache.Item{Key: key, Value: val, Expiration: m.expire})
+	return g.value
 }
 
-func (m *MemcachedCache) Get(key string) (*dns.Msg, error) {
-	var msg dns.Msg
-	item, err := m.backend.Get(key)
+// refreshGeneration reads the generation number from memcached.
+func (m *MemcachedCache) refreshGeneration() uint64 {
+	item, err := m.backend.Get(m.prefix + "generation")
+	switch err {
+	case nil:
+		gen, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil {
+			logger.Warn("Invalid memcached cache generation %q", item.Value)
+		}
+		return m.setGeneration(gen)
+	case memcache.ErrCacheMiss:
+		// A fresh start, or memcached evicted the generation. Don't go
+		// back to a generation which may still hold flushed entries.
+		gen := uint64(time.Now().UnixNano())
+		err = m.backend.Add(&memcache.Item{Key: m.prefix + "generation", Value: []byte(strconv.FormatUint(gen, 10))})
+		if err == memcache.ErrNotStored {
+			// another instance got there first, use its generation
+			if item, err = m.backend.Get(m.prefix + "generation"); err == nil {
+				gen, _ = strconv.ParseUint(string(item.Value), 10, 64)
+			}
+		}
+		return m.setGeneration(gen)
+	}
+	// keep the one we have until memcached is back
+	return m.setGeneration(0)
+}
+
+// setGeneration records gen as checked now. Generations only move forward,
+// so a read which raced with a flush doesn't bring the flushed one back.
+func (m *MemcachedCache) setGeneration(gen uint64) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g, ok := m.generation.Load().(memcachedGeneration); ok && g.value > gen {
+		gen = g.value
+	}
+	m.generation.Store(memcachedGeneration{gen, time.Now()})
+	return gen
+}
+
+// Flush deletes the entries of an exact name and type. Since the keys can't
+// be listed, flushing anything else moves on to the next generation, which
+// flushes the whole cache.
+func (m *MemcachedCache) Flush(filter CacheFilter) error {
+	if filter.Name != "" && filter.Type != "" && !filter.Suffix {
+		for _, variant := range memcachedFlushVariants {
+			key := KeyGen(Question{filter.Name, filter.Type, "IN"}, variant)
+			if err := m.Remove(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gen, err := m.backend.Increment(m.prefix+"generation", 1)
+	if err == memcache.ErrCacheMiss {
+		gen = uint64(time.Now().UnixNano())
+		err = m.backend.Set(&memcache.Item{Key: m.prefix + "generation", Value: []byte(strconv.FormatUint(gen, 10))})
+	}
 	if err != nil {
-		err = KeyNotFound{key}
-		return &msg, err
+		return err
 	}
-	err = msg.Unpack(item.Value)
+	m.setGeneration(gen)
+	return nil
+}
+
+func (m *MemcachedCache) Set(key string, msg *dns.Msg, ttl time.Duration) error {
+	now := time.Now()
+	val, err := packEntry(msg, now, now.Add(ttl))
 	if err != nil {
-		err = SerializerError{err}
+		return err
 	}
-	return &msg, err
+	return m.backend.Set(&memcache.Item{Key: m.key(key), Value: val, Expiration: memcachedExpiration(ttl+m.stale, now)})
 }
 
-func (m *MemcachedCache) Exists(key string) bool {
-	_, err := m.backend.Get(key)
+// Memcached takes expirations of more than 30 days for Unix times.
+const memcachedMaxRelativeExpiration = 30 * 24 * 60 * 60
+
+// memcachedExpiration returns the memcached expiration of an entry stored
+// at now for ttl.
+func memcachedExpiration(ttl time.Duration, now time.Time) int32 {
+	s := ttlSeconds(ttl)
+	if s <= memcachedMaxRelativeExpiration {
+		return int32(s)
+	}
+	if at := now.Unix() + s; at < math.MaxInt32 {
+		return int32(at)
+	}
+	return math.MaxInt32
+}
+
+func (m *MemcachedCache) Get(key string) (*dns.Msg, error) {
+	msg, _, err := m.GetExpire(key)
+	m.counters.count(err)
+	return msg, err
+}
+
+func (m *MemcachedCache) GetExpire(key string) (*dns.Msg, time.Time, error) {
+	item, err := m.backend.Get(m.key(key))
 	if err != nil {
-		return true
+		return nil, time.Time{}, KeyNotFound{key}
 	}
-	return false
+	return unpackEntry(key, item.Value)
+}
+
+func (m *MemcachedCache) Exists(key string) bool {
+	_, err := m.backend.Get(m.key(key))
+	return err == nil
 }
 
 func (m *MemcachedCache) Remove(key string) error {
-	return m.backend.Delete(key)
+	err := m.backend.Delete(m.key(key))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+func (m *MemcachedCache) Stats() CacheStats {
+	return m.counters.stats()
 }
 
 func (m *MemcachedCache) Full() bool {
@@ -189,74 +824,244 @@ func (m *MemcachedCache) Full() bool {
 Redis cache Backend
 */
 
-func NewRedisCache(rs RedisSettings, expire int64) *RedisCache {
+// NewRedisCache returns a cache whose keys are stored under prefix, so
+// that several caches can share the same redis db. Entries are kept for
+// stale past their expiry.
+func NewRedisCache(rs RedisSettings, prefix string, stale time.Duration) *RedisCache {
 	rc := &redis.Client{Addr: rs.Addr(), Db: rs.DB, Password: rs.Password}
 	return &RedisCache{
 		Backend: rc,
-		Expire:  expire,
+		Prefix:  prefix,
+		Stale:   stale,
 	}
 }
 
 type RedisCache struct {
+	// accessed atomically, keep it first for 64-bit alignment
+	counters getCounters
+
 	Backend *redis.Client
-	Expire  int64
+	Prefix  string
+	Stale   time.Duration
 }
 
 func (r *RedisCache) Get(key string) (*dns.Msg, error) {
-	var msg dns.Msg
-	item, err := r.Backend.Get(key)
-	if err != nil {
-		err = KeyNotFound{key}
-		return &msg, err
-	}
-	err = msg.Unpack(item)
+	msg, _, err := r.GetExpire(key)
+	r.counters.count(err)
+	return msg, err
+}
+
+func (r *RedisCache) GetExpire(key string) (*dns.Msg, time.Time, error) {
+	item, err := r.Backend.Get(r.Prefix + key)
 	if err != nil {
-		err = SerializerError{err}
+		return nil, time.Time{}, KeyNotFound{key}
 	}
-	return &msg, err
+	return unpackEntry(key, item)
 }
 
-func (r *RedisCache) Set(key string, msg *dns.Msg) error {
-	var val []byte
-	var err error
-
-	// handle cases for negacache where it sets nil values
-	if msg == nil {
-		val = []byte("nil")
-	} else {
-		val, err = msg.Pack()
-	}
+func (r *RedisCache) Set(key string, msg *dns.Msg, ttl time.Duration) error {
+	now := time.Now()
+	val, err := packEntry(msg, now, now.Add(ttl))
 	if err != nil {
-		err = SerializerError{err}
+		return err
 	}
-	return r.Backend.Setex(key, r.Expire, val)
+	return r.Backend.Setex(r.Prefix+key, ttlSeconds(ttl+r.Stale), val)
 }
 
 func (r *RedisCache) Exists(key string) bool {
-	_, err := r.Backend.Get(key)
-	if err != nil {
-		return true
-	}
-	return false
+	ok, err := r.Backend.Exists(r.Prefix + key)
+	return err == nil && ok
 }
 
 func (r *RedisCache) Remove(key string) error {
-	_, err := r.Backend.Del(key)
+	_, err := r.Backend.Del(r.Prefix + key)
 	return err
 }
 
+// Flush deletes the matching keys. It lists every key of the cache, which
+// blocks redis for a while on large ones.
+func (r *RedisCache) Flush(filter CacheFilter) error {
+	keys, err := r.Backend.Keys(r.Prefix + "*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if filter.Match(strings.TrimPrefix(key, r.Prefix)) {
+			if _, err = r.Backend.Del(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *RedisCache) Stats() CacheStats {
+	return r.counters.stats()
+}
+
 func (r *RedisCache) Full() bool {
 	return false
 }
 
-func KeyGen(q Question) string {
-	h := md5.New()
-	h.Write([]byte(q.String()))
-	x := h.Sum(nil)
-	key := fmt.Sprintf("%x", x)
+// KeyGen returns the cache key of q: its name in lower case, class and
+// type, followed by variant, if any, which tells apart the responses to q
+// that can't stand in for each other, see queryVariant. Keys are readable
+// so that the cache can be flushed by name, see CacheFilter.
+func KeyGen(q Question, variant string) string {
+	// names are case insensitive, see replyFromCache for restoring the case
+	key := strings.ToLower(q.qname) + " " + q.qclass + " " + q.qtype
+	if variant != "" {
+		key += " " + variant
+	}
 	return key
 }
 
+// msgTTL returns the smallest TTL found in the answer and authority
+// sections of msg. ok is false if msg carries no records to take it from.
+func msgTTL(msg *dns.Msg) (ttl uint32, ok bool) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if t := rrTTL(rr); !ok || t < ttl {
+				ttl = t
+			}
+			ok = true
+		}
+	}
+	return
+}
+
+// rrTTL returns the TTL of rr. As described in RFC 2308, a SOA record is
+// only good for the minimum of its own TTL and its MINIMUM field.
+func rrTTL(rr dns.RR) uint32 {
+	ttl := rr.Header().Ttl
+	if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+	return ttl
+}
+
+// isNegative reports whether msg is a NXDOMAIN or NODATA response.
+func isNegative(msg *dns.Msg) bool {
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(msg.Answer) == 0
+	}
+	return false
+}
+
+// negativeTTL returns the lifetime of a negative response, taken from the
+// SOA record in its authority section. Per RFC 2308 a negative response
+// without a SOA should not be cached, in which case ok is false.
+func negativeTTL(msg *dns.Msg) (ttl uint32, ok bool) {
+	for _, rr := range msg.Ns {
+		if _, isSOA := rr.(*dns.SOA); isSOA {
+			return rrTTL(rr), true
+		}
+	}
+	return 0, false
+}
+
+// ageMsg returns a copy of msg with every record TTL decremented by
+// elapsed, so that downstream resolvers don't cache it for longer than
+// the upstream allowed.
+func ageMsg(msg *dns.Msg, elapsed time.Duration) *dns.Msg {
+	m := msg.Copy()
+	age := uint32(elapsed / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			// The TTL field of an OPT record carries the extended rcode and flags.
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > age {
+				hdr.Ttl -= age
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// staleMsg returns a copy of msg with every record TTL set to ttl, for
+// answering with an expired entry.
+func staleMsg(msg *dns.Msg, ttl uint32) *dns.Msg {
+	m := msg.Copy()
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+	return m
+}
+
+func ttlSeconds(ttl time.Duration) int64 {
+	s := int64(ttl / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
+
+// packEntry serializes msg for the remote backends, prefixed with the time
+// it was stored, so that Get can age the TTLs, and the time it expires, so
+// that Get can tell stale entries apart.
+func packEntry(msg *dns.Msg, stored, expire time.Time) ([]byte, error) {
+	val := make([]byte, 16)
+	binary.BigEndian.PutUint64(val, uint64(stored.Unix()))
+	binary.BigEndian.PutUint64(val[8:], uint64(expire.Unix()))
+
+	// handle cases for negacache where it sets nil values
+	if msg == nil {
+		return val, nil
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, SerializerError{err}
+	}
+	return append(val, packed...), nil
+}
+
+// decodeEntry is the inverse of packEntry.
+func decodeEntry(val []byte) (Mesg, error) {
+	if len(val) < 16 {
+		return Mesg{}, SerializerError{fmt.Errorf("entry too short: %d bytes", len(val))}
+	}
+	mesg := Mesg{
+		Stored: time.Unix(int64(binary.BigEndian.Uint64(val[:8])), 0),
+		Expire: time.Unix(int64(binary.BigEndian.Uint64(val[8:16])), 0),
+	}
+	if len(val) == 16 {
+		return mesg, nil
+	}
+
+	mesg.Msg = new(dns.Msg)
+	if err := mesg.Msg.Unpack(val[16:]); err != nil {
+		return Mesg{}, SerializerError{err}
+	}
+	return mesg, nil
+}
+
+// unpackEntry decodes an entry of the remote backends, aging its TTLs.
+func unpackEntry(key string, val []byte) (*dns.Msg, time.Time, error) {
+	mesg, err := decodeEntry(val)
+	if err != nil || mesg.Msg == nil {
+		return nil, mesg.Expire, err
+	}
+
+	now := time.Now()
+	aged := ageMsg(mesg.Msg, now.Sub(mesg.Stored))
+	if mesg.Expire.Before(now) {
+		return aged, mesg.Expire, KeyExpired{key}
+	}
+	return aged, mesg.Expire, nil
+}
+
 /* we need to define marsheling to encode and decode
  */
 type JsonSerializer struct {
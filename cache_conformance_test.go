@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testCacheConformance checks that a Cache backend behaves the way the
+// handler expects, whatever it is stored in.
+func testCacheConformance(t *testing.T, name string, newCache func() Cache) {
+	Convey(name+" cache should conform to the Cache interface", t, func() {
+		cache := newCache()
+
+		Convey("Missing keys are not found", func() {
+			m, err := cache.Get("missing")
+			So(m, ShouldBeNil)
+			So(err, ShouldHaveSameTypeAs, KeyNotFound{})
+			So(cache.Exists("missing"), ShouldEqual, false)
+			So(cache.Remove("missing"), ShouldBeNil)
+		})
+
+		Convey("Stored responses are returned", func() {
+			So(cache.Set("a", newTestMsg("a.example.com", 300), time.Minute), ShouldBeNil)
+			So(cache.Exists("a"), ShouldEqual, true)
+
+			m, err := cache.Get("a")
+			So(err, ShouldBeNil)
+			So(m.Question[0].Name, ShouldEqual, "a.example.com.")
+			So(m.Answer[0].Header().Ttl, ShouldBeBetweenOrEqual, 299, 300)
+		})
+
+		Convey("Removed responses are gone", func() {
+			So(cache.Set("a", newTestMsg("a.example.com", 300), time.Minute), ShouldBeNil)
+			So(cache.Remove("a"), ShouldBeNil)
+			So(cache.Exists("a"), ShouldEqual, false)
+			_, err := cache.Get("a")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Negative entries are stored as nil", func() {
+			So(cache.Set("nil", nil, time.Minute), ShouldBeNil)
+			So(cache.Exists("nil"), ShouldEqual, true)
+
+			m, err := cache.Get("nil")
+			So(err, ShouldBeNil)
+			So(m, ShouldBeNil)
+		})
+
+		Convey("Entries expire after their ttl", func() {
+			So(cache.Set("short", newTestMsg("short.example.com", 1), time.Second), ShouldBeNil)
+			time.Sleep(1100 * time.Millisecond)
+
+			m, err := cache.Get("short")
+			So(m, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(cache.Exists("short"), ShouldEqual, false)
+		})
+
+		Convey("Flushed entries are gone", func() {
+			www := KeyGen(Question{"www.example.com", "A", "IN"}, "")
+			So(cache.Set(www, newTestMsg("www.example.com", 300), time.Minute), ShouldBeNil)
+			So(cache.Set("a", newTestMsg("a.example.com", 300), time.Minute), ShouldBeNil)
+
+			So(cache.Flush(CacheFilter{Name: "example.com", Suffix: true}), ShouldBeNil)
+			So(cache.Exists(www), ShouldEqual, false)
+
+			So(cache.Flush(CacheFilter{}), ShouldBeNil)
+			So(cache.Exists("a"), ShouldEqual, false)
+		})
+
+		Convey("Flushing a name and type leaves its other types", func() {
+			a := KeyGen(Question{"www.example.com", "A", "IN"}, "")
+			aDO := KeyGen(Question{"www.example.com", "A", "IN"}, "do")
+			aaaa := KeyGen(Question{"www.example.com", "AAAA", "IN"}, "")
+			for _, key := range []string{a, aDO, aaaa} {
+				So(cache.Set(key, newTestMsg("www.example.com", 300), time.Minute), ShouldBeNil)
+			}
+
+			So(cache.Flush(CacheFilter{Name: "www.example.com", Type: "A"}), ShouldBeNil)
+			So(cache.Exists(a), ShouldEqual, false)
+			So(cache.Exists(aDO), ShouldEqual, false)
+			So(cache.Exists(aaaa), ShouldEqual, true)
+		})
+
+		Convey("A fresh cache is not full", func() {
+			So(cache.Full(), ShouldEqual, false)
+		})
+	})
+}
+
+func TestMemoryCacheConformance(t *testing.T) {
+	testCacheConformance(t, "Memory", func() Cache {
+		c, _ := NewMemoryCache(0, 0, "", 0, 0)
+		return c
+	})
+	testCacheConformance(t, "Sharded memory", func() Cache {
+		c, _ := NewShardedCache(4, 0, 0, "", 0, 0)
+		return c
+	})
+}
+
+func TestRedisCacheConformance(t *testing.T) {
+	srv := newFakeServer(t, serveFakeRedis)
+	defer srv.Close()
+
+	n := 0
+	testCacheConformance(t, "Redis", func() Cache {
+		// a prefix per run keeps the runs apart on the shared server
+		n++
+		rs := RedisSettings{Host: "127.0.0.1", Port: srv.Port()}
+		return NewRedisCache(rs, "test"+strconv.Itoa(n)+":", 0)
+	})
+}
+
+func TestMemcachedCacheConformance(t *testing.T) {
+	srv := newFakeServer(t, serveFakeMemcached)
+	defer srv.Close()
+
+	n := 0
+	testCacheConformance(t, "Memcached", func() Cache {
+		n++
+		return NewMemcachedCache([]string{srv.Addr()}, "test"+strconv.Itoa(n)+":", 0)
+	})
+
+	Convey("Memcached entries should outlive 30 days TTLs", t, func() {
+		cache := NewMemcachedCache([]string{srv.Addr()}, "long:", 24*time.Hour)
+		So(cache.Set("a", newTestMsg("a.example.com", 300), 40*24*time.Hour), ShouldBeNil)
+		_, err := cache.Get("a")
+		So(err, ShouldBeNil)
+
+		now := time.Now()
+		So(memcachedExpiration(time.Hour, now), ShouldEqual, 3600)
+		So(memcachedExpiration(40*24*time.Hour, now), ShouldEqual, now.Unix()+40*24*60*60)
+	})
+
+	Convey("Memcached flushes should reach the other instances", t, func() {
+		a := NewMemcachedCache([]string{srv.Addr()}, "shared:", 0)
+		b := NewMemcachedCache([]string{srv.Addr()}, "shared:", 0)
+		So(a.Set("x", newTestMsg("x.example.com", 300), time.Minute), ShouldBeNil)
+		So(b.Exists("x"), ShouldEqual, true)
+
+		So(a.Flush(CacheFilter{}), ShouldBeNil)
+		So(a.Exists("x"), ShouldEqual, false)
+
+		// b checks the generation again in the background once it's old
+		time.Sleep(memcachedGenerationTTL)
+		flushed := false
+		for i := 0; i < 20 && !flushed; i++ {
+			flushed = !b.Exists("x")
+			time.Sleep(50 * time.Millisecond)
+		}
+		So(flushed, ShouldEqual, true)
+	})
+}
+
+func TestTieredCacheConformance(t *testing.T) {
+	srv := newFakeServer(t, serveFakeRedis)
+	defer srv.Close()
+
+	n := 0
+	testCacheConformance(t, "Tiered", func() Cache {
+		n++
+		l1, _ := NewMemoryCache(0, 0, "", 0, 0)
+		rs := RedisSettings{Host: "127.0.0.1", Port: srv.Port()}
+		return NewTieredCache(l1, NewRedisCache(rs, "test"+strconv.Itoa(n)+":", 0))
+	})
+}
+
+/*
+In-process stand-ins for redis and memcached, speaking just enough of their
+protocols for the cache backends.
+*/
+
+type fakeItem struct {
+	value  []byte
+	expire time.Time
+}
+
+type fakeStore struct {
+	mu          sync.Mutex
+	items       map[string]fakeItem
+	subscribers map[string][]io.Writer
+}
+
+func (s *fakeStore) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !item.expire.IsZero() && !time.Now().Before(item.expire) {
+		delete(s.items, key)
+		return nil, false
+	}
+	return item.value, true
+}
+
+func (s *fakeStore) set(key string, value []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item := fakeItem{value: value}
+	if ttl > 0 {
+		item.expire = time.Now().Add(ttl)
+	}
+	s.items[key] = item
+}
+
+func (s *fakeStore) del(key string) bool {
+	_, ok := s.get(key)
+	s.mu.Lock()
+	delete(s.items, key)
+	s.mu.Unlock()
+	return ok
+}
+
+func (s *fakeStore) keys(pattern string) []string {
+	s.mu.Lock()
+	var keys []string
+	for key := range s.items {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.Unlock()
+
+	var live []string
+	for _, key := range keys {
+		if _, ok := s.get(key); ok {
+			live = append(live, key)
+		}
+	}
+	return live
+}
+
+type fakeServer struct {
+	ln    net.Listener
+	store *fakeStore
+}
+
+func newFakeServer(t *testing.T, serve func(*fakeStore, *bufio.Reader, io.Writer) error) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &fakeStore{
+		items:       make(map[string]fakeItem),
+		subscribers: make(map[string][]io.Writer),
+	}
+	srv := &fakeServer{ln: ln, store: store}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for serve(srv.store, r, conn) == nil {
+				}
+			}()
+		}
+	}()
+	return srv
+}
+
+func (s *fakeServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeServer) Close() {
+	s.ln.Close()
+}
+
+// readRedisCommand reads a RESP array or an inline command.
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, _ := strconv.Atoi(line[1:])
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func serveFakeRedis(s *fakeStore, r *bufio.Reader, w io.Writer) error {
+	args, err := readRedisCommand(r)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	bulk := func(v []byte) {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	}
+	boolean := func(b bool) {
+		if b {
+			io.WriteString(w, ":1\r\n")
+		} else {
+			io.WriteString(w, ":0\r\n")
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		io.WriteString(w, "+PONG\r\n")
+	case "AUTH", "SELECT":
+		io.WriteString(w, "+OK\r\n")
+	case "GET":
+		if v, ok := s.get(args[1]); ok {
+			bulk(v)
+		} else {
+			io.WriteString(w, "$-1\r\n")
+		}
+	case "SET":
+		s.set(args[1], []byte(args[2]), 0)
+		io.WriteString(w, "+OK\r\n")
+	case "SETEX":
+		secs, _ := strconv.Atoi(args[2])
+		s.set(args[1], []byte(args[3]), time.Duration(secs)*time.Second)
+		io.WriteString(w, "+OK\r\n")
+	case "DEL":
+		boolean(s.del(args[1]))
+	case "EXISTS":
+		_, ok := s.get(args[1])
+		boolean(ok)
+	case "KEYS":
+		keys := s.keys(args[1])
+		fmt.Fprintf(w, "*%d\r\n", len(keys))
+		for _, key := range keys {
+			bulk([]byte(key))
+		}
+	case "SUBSCRIBE":
+		s.mu.Lock()
+		for _, channel := range args[1:] {
+			fmt.Fprintf(w, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)
+			s.subscribers[channel] = append(s.subscribers[channel], w)
+		}
+		s.mu.Unlock()
+	case "PUBLISH":
+		s.mu.Lock()
+		subscribers := s.subscribers[args[1]]
+		for _, sub := range subscribers {
+			fmt.Fprintf(sub, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n", len(args[1]), args[1])
+			bulk := []byte(args[2])
+			fmt.Fprintf(sub, "$%d\r\n%s\r\n", len(bulk), bulk)
+		}
+		s.mu.Unlock()
+		fmt.Fprintf(w, ":%d\r\n", len(subscribers))
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+	return nil
+}
+
+// memcachedTTL reads an expiration as memcached does: over 30 days, it is a
+// Unix time. ok is false if that time is already past.
+func memcachedTTL(exptime int) (ttl time.Duration, ok bool) {
+	if exptime <= 30*24*60*60 {
+		return time.Duration(exptime) * time.Second, true
+	}
+	ttl = time.Until(time.Unix(int64(exptime), 0))
+	return ttl, ttl > 0
+}
+
+func serveFakeMemcached(s *fakeStore, r *bufio.Reader, w io.Writer) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "get", "gets":
+		for _, key := range fields[1:] {
+			if v, ok := s.get(key); ok {
+				fmt.Fprintf(w, "VALUE %s 0 %d 0\r\n%s\r\n", key, len(v), v)
+			}
+		}
+		io.WriteString(w, "END\r\n")
+	case "set", "add":
+		exptime, _ := strconv.Atoi(fields[3])
+		size, _ := strconv.Atoi(fields[4])
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if _, ok := s.get(fields[1]); ok && fields[0] == "add" {
+			io.WriteString(w, "NOT_STORED\r\n")
+			return nil
+		}
+		if ttl, ok := memcachedTTL(exptime); ok {
+			s.set(fields[1], buf[:size], ttl)
+		} else {
+			s.del(fields[1])
+		}
+		io.WriteString(w, "STORED\r\n")
+	case "incr":
+		v, ok := s.get(fields[1])
+		if !ok {
+			io.WriteString(w, "NOT_FOUND\r\n")
+			return nil
+		}
+		n, _ := strconv.ParseUint(string(v), 10, 64)
+		delta, _ := strconv.ParseUint(fields[2], 10, 64)
+		v = []byte(strconv.FormatUint(n+delta, 10))
+		s.set(fields[1], v, 0)
+		fmt.Fprintf(w, "%s\r\n", v)
+	case "delete":
+		if s.del(fields[1]) {
+			io.WriteString(w, "DELETED\r\n")
+		} else {
+			io.WriteString(w, "NOT_FOUND\r\n")
+		}
+	default:
+		io.WriteString(w, "ERROR\r\n")
+	}
+	return nil
+}
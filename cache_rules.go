@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheRules picks the cache rule of a name: the one of its longest domain
+// suffix found in the [[cache.rules]] settings.
+type CacheRules struct {
+	tree  *suffixTreeNode
+	rules map[string]CacheRule
+}
+
+func NewCacheRules(rules []CacheRule) (*CacheRules, error) {
+	r := &CacheRules{
+		tree:  newSuffixTreeRoot(),
+		rules: make(map[string]CacheRule),
+	}
+	for _, rule := range rules {
+		domain := strings.ToLower(UnFqdn(rule.Domain))
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+			return nil, fmt.Errorf("invalid cache rule domain %q", rule.Domain)
+		}
+		if rule.MaxTTL > 0 && rule.MinTTL > rule.MaxTTL {
+			return nil, fmt.Errorf("cache rule %s has min-ttl above max-ttl", domain)
+		}
+		// the tree maps the suffix to itself, the rule is kept aside
+		r.tree.sinsert(strings.Split(domain, "."), domain)
+		r.rules[domain] = rule
+	}
+	return r, nil
+}
+
+// Match returns the rule that applies to qname, if any.
+func (r *CacheRules) Match(qname string) (CacheRule, bool) {
+	if len(r.rules) == 0 {
+		return CacheRule{}, false
+	}
+	domain, ok := r.tree.search(strings.Split(strings.ToLower(UnFqdn(qname)), "."))
+	if !ok {
+		return CacheRule{}, false
+	}
+	return r.rules[domain], true
+}
+
+// ClampTTL bounds ttl like CacheSettings.ClampTTL does, the bounds of the
+// rule taking precedence over the global ones.
+func (rule CacheRule) ClampTTL(cs CacheSettings, ttl uint32) time.Duration {
+	if rule.MinTTL > 0 {
+		cs.MinTTL = rule.MinTTL
+		if cs.MaxTTL > 0 && cs.MaxTTL < rule.MinTTL {
+			cs.MaxTTL = rule.MinTTL
+		}
+	}
+	if rule.MaxTTL > 0 {
+		cs.MaxTTL = rule.MaxTTL
+		if cs.MinTTL > rule.MaxTTL {
+			cs.MinTTL = rule.MaxTTL
+		}
+	}
+	return cs.ClampTTL(ttl)
+}
+
+// ServeStale tells whether expired answers may be served for the names the
+// rule applies to, serveStale being the global serve-stale setting.
+func (rule CacheRule) ServeStale(serveStale bool) bool {
+	if rule.StaleAllowed == nil {
+		return serveStale
+	}
+	return *rule.StaleAllowed
+}
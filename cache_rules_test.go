@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCacheRules(t *testing.T) {
+	Convey("Cache rules should match by domain suffix", t, func() {
+		no := false
+		rules, err := NewCacheRules([]CacheRule{
+			{Domain: "health.lb.internal", NoCache: true},
+			{Domain: "slow.example.com.", MinTTL: 3600},
+			{Domain: "fast.slow.example.com", MaxTTL: 5, StaleAllowed: &no},
+		})
+		So(err, ShouldBeNil)
+
+		rule, ok := rules.Match("a.Health.lb.internal")
+		So(ok, ShouldEqual, true)
+		So(rule.NoCache, ShouldEqual, true)
+
+		rule, ok = rules.Match("www.slow.example.com.")
+		So(ok, ShouldEqual, true)
+		So(rule.MinTTL, ShouldEqual, 3600)
+		So(rule.ServeStale(true), ShouldEqual, true)
+		So(rule.ServeStale(false), ShouldEqual, false)
+
+		rule, ok = rules.Match("fast.slow.example.com")
+		So(ok, ShouldEqual, true)
+		So(rule.MaxTTL, ShouldEqual, 5)
+		So(rule.ServeStale(true), ShouldEqual, false)
+
+		_, ok = rules.Match("lb.internal")
+		So(ok, ShouldEqual, false)
+		_, ok = rules.Match("example.com")
+		So(ok, ShouldEqual, false)
+
+		Convey("Invalid rules should be rejected", func() {
+			_, err = NewCacheRules([]CacheRule{{Domain: ""}})
+			So(err, ShouldNotBeNil)
+			_, err = NewCacheRules([]CacheRule{{Domain: "example.com", MinTTL: 60, MaxTTL: 30}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Rule TTL bounds should take precedence over the global ones", t, func() {
+		cs := CacheSettings{MinTTL: 10, MaxTTL: 600}
+
+		So(CacheRule{}.ClampTTL(cs, 3600), ShouldEqual, 600*time.Second)
+		So(CacheRule{MinTTL: 3600}.ClampTTL(cs, 30), ShouldEqual, 3600*time.Second)
+		So(CacheRule{MaxTTL: 5}.ClampTTL(cs, 30), ShouldEqual, 5*time.Second)
+		So(CacheRule{MaxTTL: 5}.ClampTTL(cs, 1), ShouldEqual, 5*time.Second)
+	})
+	Convey("A rule allowing stale answers should keep expired entries", t, func() {
+		yes, no := true, false
+		cs := CacheSettings{StaleWindow: 60}
+		So(cs.StaleWindowDuration(), ShouldEqual, 0)
+		cs.Rules = []CacheRule{{Domain: "example.com", StaleAllowed: &no}}
+		So(cs.StaleWindowDuration(), ShouldEqual, 0)
+		cs.Rules = append(cs.Rules, CacheRule{Domain: "example.org", StaleAllowed: &yes})
+		So(cs.StaleWindowDuration(), ShouldEqual, time.Minute)
+	})
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTestMsg(qname string, ttls ...uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), dns.TypeA)
+	for _, ttl := range ttls {
+		rr, _ := dns.NewRR(dns.Fqdn(qname) + " IN A 127.0.0.1")
+		rr.Header().Ttl = ttl
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestMsgTTL(t *testing.T) {
+	Convey("Cache lifetime should be derived from record TTLs", t, func() {
+		Convey("The smallest TTL wins", func() {
+			ttl, ok := msgTTL(newTestMsg("www.example.com", 300, 30, 600))
+			So(ok, ShouldEqual, true)
+			So(ttl, ShouldEqual, 30)
+		})
+
+		Convey("A response without records has no TTL", func() {
+			_, ok := msgTTL(newTestMsg("www.example.com"))
+			So(ok, ShouldEqual, false)
+		})
+
+		Convey("Settings clamp the TTL", func() {
+			cs := CacheSettings{MinTTL: 60, MaxTTL: 3600}
+			So(cs.ClampTTL(30), ShouldEqual, time.Minute)
+			So(cs.ClampTTL(86400), ShouldEqual, time.Hour)
+			So(CacheSettings{}.ClampTTL(86400), ShouldEqual, 24*time.Hour)
+		})
+	})
+}
+
+func TestAgeMsg(t *testing.T) {
+	Convey("Aged responses should have decremented TTLs", t, func() {
+		m := newTestMsg("www.example.com", 300, 5)
+		m.SetEdns0(4096, true)
+
+		aged := ageMsg(m, 10*time.Second)
+		So(aged.Answer[0].Header().Ttl, ShouldEqual, 290)
+		So(aged.Answer[1].Header().Ttl, ShouldEqual, 0)
+		So(aged.IsEdns0().Do(), ShouldEqual, true)
+
+		Convey("The original message should be left untouched", func() {
+			So(m.Answer[0].Header().Ttl, ShouldEqual, 300)
+		})
+	})
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	Convey("Memory cache should honor the given TTL", t, func() {
+		cache, _ := NewMemoryCache(0, 0, "", 0, 0)
+
+		So(cache.Set("a", newTestMsg("a.example.com", 300), time.Minute), ShouldBeNil)
+		So(cache.Set("b", newTestMsg("b.example.com", 300), -time.Second), ShouldBeNil)
+
+		m, err := cache.Get("a")
+		So(err, ShouldBeNil)
+		So(m.Answer[0].Header().Ttl, ShouldEqual, 300)
+
+		_, err = cache.Get("b")
+		So(err, ShouldHaveSameTypeAs, KeyExpired{})
+	})
+}
+
+func TestMemoryCacheStale(t *testing.T) {
+	Convey("Expired entries should be kept for the stale window", t, func() {
+		cache, _ := NewMemoryCache(0, 0, "", 0, time.Minute)
+
+		cache.Set("a", newTestMsg("a.example.com", 300), -time.Second)
+		cache.Set("b", newTestMsg("b.example.com", 300), -2*time.Minute)
+
+		m, err := cache.Get("a")
+		So(err, ShouldHaveSameTypeAs, KeyExpired{})
+		So(m, ShouldNotBeNil)
+
+		m, err = cache.Get("b")
+		So(err, ShouldHaveSameTypeAs, KeyExpired{})
+		So(m, ShouldBeNil)
+
+		Convey("Stale answers should carry the stale answer TTL", func() {
+			m, _ = cache.Get("a")
+			So(staleMsg(m, 30).Answer[0].Header().Ttl, ShouldEqual, 30)
+		})
+	})
+}
+
+func TestMemoryCacheIsolation(t *testing.T) {
+	Convey("Cached responses should not be shared with callers", t, func() {
+		cache, _ := NewMemoryCache(0, 0, "", 0, 0)
+
+		m := newTestMsg("a.example.com", 300)
+		cache.Set("a", m, time.Minute)
+		m.Answer[0].Header().Ttl = 1
+
+		hit, _ := cache.Get("a")
+		So(hit.Answer[0].Header().Ttl, ShouldEqual, 300)
+		hit.Answer[0].Header().Ttl = 1
+		hit.Id = 42
+
+		hit, _ = cache.Get("a")
+		So(hit.Answer[0].Header().Ttl, ShouldEqual, 300)
+		So(hit.Id, ShouldNotEqual, 42)
+
+		Convey("Concurrent hits may rewrite their copy", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					req := new(dns.Msg)
+					req.SetQuestion("A.Example.COM.", dns.TypeA)
+					for j := 0; j < 100; j++ {
+						hit, err := cache.Get("a")
+						if err != nil {
+							continue
+						}
+						replyFromCache(req, hit)
+						hit.Pack()
+						if j%10 == 0 {
+							cache.Set("a", hit, time.Minute)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	})
+}
+
+func TestReplyFromCache(t *testing.T) {
+	Convey("Cached responses should answer with the client's id and case", t, func() {
+		req := new(dns.Msg)
+		req.SetQuestion("WwW.ExAmple.com.", dns.TypeA)
+
+		m := replyFromCache(req, newTestMsg("www.example.com", 300))
+		So(m.Id, ShouldEqual, req.Id)
+		So(m.Question[0].Name, ShouldEqual, "WwW.ExAmple.com.")
+		So(m.Answer[0].Header().Name, ShouldEqual, "WwW.ExAmple.com.")
+
+		Convey("The case doesn't change the cache key", func() {
+			So(KeyGen(Question{"WwW.ExAmple.com", "A", "IN"}, ""), ShouldEqual,
+				KeyGen(Question{"www.example.com", "A", "IN"}, ""))
+		})
+	})
+}
+
+func TestCacheFilter(t *testing.T) {
+	Convey("Cache filters should select entries by question", t, func() {
+		www := KeyGen(Question{"WWW.example.com", "A", "IN"}, "do")
+		aaaa := KeyGen(Question{"www.example.com", "AAAA", "IN"}, "")
+		apex := KeyGen(Question{"example.com", "A", "IN"}, "")
+		other := KeyGen(Question{"badexample.com", "A", "IN"}, "")
+
+		all := CacheFilter{}
+		So(all.Match(www) && all.Match(aaaa) && all.Match(other), ShouldEqual, true)
+
+		name := CacheFilter{Name: "www.example.com"}
+		So(name.Match(www), ShouldEqual, true)
+		So(name.Match(aaaa), ShouldEqual, true)
+		So(name.Match(apex), ShouldEqual, false)
+
+		typed := CacheFilter{Name: "www.example.com", Type: "AAAA"}
+		So(typed.Match(www), ShouldEqual, false)
+		So(typed.Match(aaaa), ShouldEqual, true)
+
+		suffix := CacheFilter{Name: "example.com", Suffix: true}
+		So(suffix.Match(www), ShouldEqual, true)
+		So(suffix.Match(apex), ShouldEqual, true)
+		So(suffix.Match(other), ShouldEqual, false)
+	})
+
+	Convey("Memory cache should only flush the selected entries", t, func() {
+		cache, _ := NewShardedCache(4, 0, 0, "lru", 0, 0)
+		www := KeyGen(Question{"www.example.com", "A", "IN"}, "")
+		other := KeyGen(Question{"www.example.org", "A", "IN"}, "")
+		cache.Set(www, newTestMsg("www.example.com", 300), time.Minute)
+		cache.Set(other, newTestMsg("www.example.org", 300), time.Minute)
+
+		So(cache.Flush(CacheFilter{Name: "com", Suffix: true}), ShouldBeNil)
+		So(cache.Exists(www), ShouldEqual, false)
+		So(cache.Exists(other), ShouldEqual, true)
+	})
+}
+
+func TestMemoryCacheStats(t *testing.T) {
+	Convey("Memory cache should count its hits, misses and entries", t, func() {
+		cache, _ := NewMemoryCache(0, 0, "", 0, 0)
+
+		So(cache.Set("a", newTestMsg("a.example.com", 300), time.Minute), ShouldBeNil)
+		cache.Get("a")
+		cache.Get("b")
+
+		stats := cache.Stats()
+		So(stats.Hits, ShouldEqual, 1)
+		So(stats.Misses, ShouldEqual, 1)
+		So(stats.Entries, ShouldEqual, 1)
+		So(stats.Bytes, ShouldBeGreaterThan, newTestMsg("a.example.com", 300).Len())
+
+		Convey("Replaced and removed entries should give their bytes back", func() {
+			So(cache.Set("a", newTestMsg("a.example.com", 300, 300), time.Minute), ShouldBeNil)
+			So(cache.Stats().Bytes, ShouldBeGreaterThan, stats.Bytes)
+			cache.Remove("a")
+			So(cache.Stats().Bytes, ShouldEqual, 0)
+		})
+
+		Convey("Evictions should be counted", func() {
+			lru, _ := NewMemoryCache(1, 0, "lru", 0, 0)
+			lru.Set("a", newTestMsg("a.example.com", 300), time.Minute)
+			lru.Set("b", newTestMsg("b.example.com", 300), time.Minute)
+			So(lru.Stats().Evicted, ShouldEqual, 1)
+			So(lru.Stats().Entries, ShouldEqual, 1)
+			So(lru.Stats().Bytes, ShouldEqual, entrySize("b", Mesg{Msg: newTestMsg("b.example.com", 300)}))
+		})
+	})
+}
+
+func TestNegativeTTL(t *testing.T) {
+	Convey("Negative responses should be cached for the SOA minimum", t, func() {
+		m := newTestMsg("nx.example.com")
+		m.Rcode = dns.RcodeNameError
+		So(isNegative(m), ShouldEqual, true)
+
+		_, ok := negativeTTL(m)
+		So(ok, ShouldEqual, false)
+
+		soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300")
+		m.Ns = append(m.Ns, soa)
+		ttl, ok := negativeTTL(m)
+		So(ok, ShouldEqual, true)
+		So(ttl, ShouldEqual, 300)
+
+		Convey("An empty NOERROR response is NODATA", func() {
+			m.Rcode = dns.RcodeSuccess
+			So(isNegative(m), ShouldEqual, true)
+			So(isNegative(newTestMsg("www.example.com", 300)), ShouldEqual, false)
+		})
+	})
+}
+
+func TestShardedCache(t *testing.T) {
+	Convey("Sharded cache should spread keys and split maxcount", t, func() {
+		cache, err := NewShardedCache(4, 8, 0, "lru", 0, 0)
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 100; i++ {
+			key := KeyGen(Question{strconv.Itoa(i) + ".example.com", "A", "IN"}, "")
+			So(cache.Set(key, newTestMsg("example.com", 300), time.Minute), ShouldBeNil)
+		}
+		So(cache.Length(), ShouldBeLessThanOrEqualTo, 8)
+		So(cache.Evicted(), ShouldEqual, 100-cache.Length())
+
+		key := KeyGen(Question{"www.example.com", "A", "IN"}, "")
+		cache.Set(key, newTestMsg("www.example.com", 300), time.Minute)
+		m, err := cache.Get(key)
+		So(err, ShouldBeNil)
+		So(m.Question[0].Name, ShouldEqual, "www.example.com.")
+	})
+}
+
+// benchmarkCache runs a 9:1 Get/Set mix over a set of hot keys from every
+// GOMAXPROCS goroutine, compare with: go test -bench=Cache -cpu=1,4,16,32
+func benchmarkCache(b *testing.B, cache Cache) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = KeyGen(Question{strconv.Itoa(i) + ".example.com", "A", "IN"}, "")
+		cache.Set(keys[i], newTestMsg(strconv.Itoa(i)+".example.com", 300), time.Hour)
+	}
+	msg := newTestMsg("example.com", 300)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%10 == 0 {
+				cache.Set(key, msg, time.Hour)
+			} else {
+				cache.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemoryCache(b *testing.B) {
+	cache, _ := NewMemoryCache(0, 0, "", 0, 0)
+	benchmarkCache(b, cache)
+}
+
+func BenchmarkMemoryCacheLRU(b *testing.B) {
+	cache, _ := NewMemoryCache(4096, 0, "lru", 0, 0)
+	benchmarkCache(b, cache)
+}
+
+func BenchmarkShardedCache(b *testing.B) {
+	cache, _ := NewShardedCache(runtime.GOMAXPROCS(0)*4, 0, 0, "", 0, 0)
+	benchmarkCache(b, cache)
+}
+
+func BenchmarkShardedCacheLRU(b *testing.B) {
+	cache, _ := NewShardedCache(runtime.GOMAXPROCS(0)*4, 4096, 0, "lru", 0, 0)
+	benchmarkCache(b, cache)
+}
+
+func TestTieredCache(t *testing.T) {
+	Convey("Tiered cache should read and write through the local tier", t, func() {
+		l1, _ := NewMemoryCache(0, 0, "", 0, 0)
+		l2, _ := NewMemoryCache(0, 0, "", 0, 0)
+		cache := NewTieredCache(l1, l2)
+
+		So(cache.Set("a", newTestMsg("a.example.com", 300), time.Minute), ShouldBeNil)
+		So(l1.Exists("a"), ShouldEqual, true)
+		So(l2.Exists("a"), ShouldEqual, true)
+
+		Convey("Shared entries should be copied locally with their expiry", func() {
+			l2.Set("b", newTestMsg("b.example.com", 300), time.Minute)
+			_, err := cache.Get("b")
+			So(err, ShouldBeNil)
+
+			_, expire, err := l1.GetExpire("b")
+			So(err, ShouldBeNil)
+			_, l2Expire, _ := l2.GetExpire("b")
+			So(expire, ShouldHappenWithin, time.Second, l2Expire)
+		})
+
+		Convey("Remove should drop both tiers", func() {
+			cache.Remove("a")
+			So(cache.Exists("a"), ShouldEqual, false)
+		})
+
+		Convey("The local tier should be written when the shared one is down", func() {
+			if logger == nil {
+				logger = NewLogger()
+			}
+			srv := newFakeServer(t, serveFakeRedis)
+			srv.Close()
+			down := NewTieredCache(l1, NewRedisCache(RedisSettings{Host: "127.0.0.1", Port: srv.Port()}, "down:", 0))
+
+			So(down.Set("c", newTestMsg("c.example.com", 300), time.Minute), ShouldBeNil)
+			m, err := down.Get("c")
+			So(err, ShouldBeNil)
+			So(m.Question[0].Name, ShouldEqual, "c.example.com.")
+		})
+	})
+}
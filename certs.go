@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// CertReloader serves the certificate of a certificate and key file pair to
+// TLS listeners, and loads it again on Reload, so that renewed certificates
+// are picked up without a restart.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files again. The previous certificate is kept if they
+// can't be loaded.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a server configuration with the certificate.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate, MinVersion: tls.VersionTLS12}
+}
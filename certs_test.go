@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCertReloader(t *testing.T) {
+	first, second := newTestCert(t), newTestCert(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	install := func(c *testCert) {
+		for src, dst := range map[string]string{c.caFile: certFile, c.keyFile: keyFile} {
+			buf, err := ioutil.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(dst, buf, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	Convey("CertReloader", t, func() {
+		install(first)
+		certs, err := NewCertReloader(certFile, keyFile)
+		So(err, ShouldBeNil)
+
+		current := func() []byte {
+			cert, err := certs.GetCertificate(nil)
+			So(err, ShouldBeNil)
+			return cert.Certificate[0]
+		}
+
+		Convey("Should serve the certificate of the files", func() {
+			So(current(), ShouldResemble, first.tls.Certificate[0])
+		})
+
+		Convey("Should pick a renewed certificate up on reload", func() {
+			install(second)
+			So(certs.Reload(), ShouldBeNil)
+			So(current(), ShouldResemble, second.tls.Certificate[0])
+		})
+
+		Convey("Should keep the certificate when the files are broken", func() {
+			So(ioutil.WriteFile(keyFile, []byte("garbage"), 0600), ShouldBeNil)
+			So(certs.Reload(), ShouldNotBeNil)
+			So(current(), ShouldResemble, first.tls.Certificate[0])
+		})
+
+		Convey("Should fail on missing files", func() {
+			_, err := NewCertReloader(filepath.Join(dir, "missing.pem"), keyFile)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestServeTLS(t *testing.T) {
+	cert := newTestCert(t)
+	certs, err := NewCertReloader(cert.caFile, cert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int64
+	_, upstream := newTestUpstream(t, answerA(60, &queries))
+	h := newTestHandler(upstream)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: tls.NewListener(l, certs.TLSConfig()), Net: "tcp-tls", Handler: dns.HandlerFunc(h.DoTCP)}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	defer srv.Shutdown()
+
+	Convey("DNS over TLS listener", t, func() {
+		Convey("Should answer clients trusting its certificate", func() {
+			u, err := NewUpstream("tls://"+l.Addr().String()+"?name=dns.test&ca="+url.QueryEscape(cert.caFile), 2*time.Second)
+			So(err, ShouldBeNil)
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			r, _, err := u.Exchange(req)
+			So(err, ShouldBeNil)
+			So(r.Answer, ShouldHaveLength, 1)
+			So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+		})
+	})
+}
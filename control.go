@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ControlServer is the HTTP control interface of a running godns. It has
+// no authentication, so it should only listen on a trusted address.
+//
+//	POST /cache/flush                          flush the whole cache
+//	POST /cache/flush?name=example.com&type=A  flush a name, or a name and type
+//	POST /cache/flush?name=example.com&suffix=1  flush a domain and its subdomains
+//	GET  /stats                                cache statistics, as JSON
+//	GET  /metrics                              the same, for Prometheus
+//	GET  /upstreams                            nameserver health, as JSON
+type ControlServer struct {
+	handler *GODNSHandler
+	mux     *http.ServeMux
+}
+
+func NewControlServer(h *GODNSHandler) *ControlServer {
+	c := &ControlServer{handler: h, mux: http.NewServeMux()}
+	c.mux.HandleFunc("/cache/flush", c.flush)
+	c.mux.HandleFunc("/stats", c.stats)
+	c.mux.HandleFunc("/metrics", c.metrics)
+	c.mux.HandleFunc("/upstreams", c.upstreams)
+	return c
+}
+
+func (c *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mux.ServeHTTP(w, r)
+}
+
+func (c *ControlServer) ListenAndServe(addr string) {
+	logger.Info("Start control listener on %s", addr)
+	if err := http.ListenAndServe(addr, c); err != nil {
+		logger.Error("Start control listener on %s failed:%s", addr, err.Error())
+	}
+}
+
+func (c *ControlServer) flush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseCacheFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = c.handler.Flush(filter); err != nil {
+		logger.Warn("Flush cache failed: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func (c *ControlServer) stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.handler.Stats())
+}
+
+func (c *ControlServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.handler.Stats().WritePrometheus(w)
+}
+
+func (c *ControlServer) upstreams(w http.ResponseWriter, r *http.Request) {
+	status := c.handler.resolver.UpstreamStatus()
+	if status == nil {
+		status = []UpstreamStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
+
+func parseCacheFilter(r *http.Request) (CacheFilter, error) {
+	var filter CacheFilter
+	q := r.URL.Query()
+
+	if name := q.Get("name"); name != "" {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return filter, fmt.Errorf("invalid name %q", name)
+		}
+		filter.Name = strings.ToLower(UnFqdn(name))
+	}
+	if qtype := q.Get("type"); qtype != "" {
+		if _, ok := dns.StringToType[strings.ToUpper(qtype)]; !ok {
+			return filter, fmt.Errorf("invalid type %q", qtype)
+		}
+		filter.Type = strings.ToUpper(qtype)
+	}
+	if suffix := q.Get("suffix"); suffix != "" {
+		ok, err := strconv.ParseBool(suffix)
+		if err != nil {
+			return filter, fmt.Errorf("invalid suffix %q", suffix)
+		}
+		if ok && filter.Name == "" {
+			return filter, fmt.Errorf("suffix needs a name")
+		}
+		filter.Suffix = ok
+	}
+	return filter, nil
+}
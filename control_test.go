@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestControlFlush(t *testing.T) {
+	if logger == nil {
+		logger = NewLogger()
+	}
+
+	Convey("The control interface should flush the cache", t, func() {
+		cache, _ := NewMemoryCache(0, 0, "", 0, 0)
+		negCache, _ := NewMemoryCache(0, 0, "", 0, 0)
+		failCache, _ := NewMemoryCache(0, 0, "", 0, 0)
+		h := &GODNSHandler{cache: cache, negCache: negCache, failCache: failCache}
+
+		www := KeyGen(Question{"www.example.com", "A", "IN"}, "")
+		nx := KeyGen(Question{"nx.example.com", "A", "IN"}, "")
+		other := KeyGen(Question{"www.example.org", "A", "IN"}, "")
+		cache.Set(www, newTestMsg("www.example.com", 300), time.Minute)
+		cache.Set(other, newTestMsg("www.example.org", 300), time.Minute)
+		negCache.Set(nx, newTestMsg("nx.example.com"), time.Minute)
+
+		srv := httptest.NewServer(NewControlServer(h))
+		defer srv.Close()
+
+		resp, err := http.Post(srv.URL+"/cache/flush?name=Example.com.&suffix=1", "", nil)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(cache.Exists(www), ShouldEqual, false)
+		So(negCache.Exists(nx), ShouldEqual, false)
+		So(cache.Exists(other), ShouldEqual, true)
+
+		resp, err = http.Post(srv.URL+"/cache/flush", "", nil)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(cache.Exists(other), ShouldEqual, false)
+
+		Convey("Statistics should be exported", func() {
+			cache.Get(www)
+			resp, err = http.Get(srv.URL + "/stats")
+			So(err, ShouldBeNil)
+			var stats Stats
+			So(json.NewDecoder(resp.Body).Decode(&stats), ShouldBeNil)
+			So(stats.Caches["answer"].Misses, ShouldEqual, 1)
+
+			resp, err = http.Get(srv.URL + "/metrics")
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			So(string(body), ShouldContainSubstring, `godns_cache_lookups_miss_total{cache="answer"} 1`)
+		})
+
+		Convey("Bad requests should be refused", func() {
+			resp, _ = http.Get(srv.URL + "/cache/flush")
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+
+			resp, _ = http.Post(srv.URL+"/cache/flush?type=BOGUS", "", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			resp, _ = http.Post(srv.URL+"/cache/flush?suffix=1", "", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dnsJSONType = "application/dns-json"
+
+// DoHServer answers DNS over HTTPS queries (RFC 8484) with a GODNSHandler:
+//
+//	GET  /dns-query?dns=<base64url query>
+//	POST /dns-query with an application/dns-message query
+//	GET  /dns-query?name=example.com&type=AAAA  the JSON API, if enabled
+//
+// Behind a reverse proxy, the client address is taken from the
+// X-Forwarded-For header of the trusted proxies.
+type DoHServer struct {
+	handler *GODNSHandler
+	path    string
+	json    bool
+	proxies []*net.IPNet
+}
+
+func NewDoHServer(h *GODNSHandler, s ServerHTTPSSettings) (*DoHServer, error) {
+	d := &DoHServer{handler: h, path: s.Path, json: s.JSON}
+	if d.path == "" {
+		d.path = "/dns-query"
+	}
+	for _, proxy := range s.TrustedProxies {
+		cidr := proxy
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		d.proxies = append(d.proxies, ipnet)
+	}
+	return d, nil
+}
+
+func (d *DoHServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != d.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if d.json && q.Get("dns") == "" && q.Get("name") != "" {
+			d.serveJSON(w, r)
+			return
+		}
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(q.Get("dns"), "="))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil || len(req.Question) != 1 {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+
+	m := d.resolve(r, req)
+	if m == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+	out, err := m.Pack()
+	if err != nil {
+		logger.Warn("Pack %s response failed: %s", req.Question[0].Name, err)
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(m))))
+	w.Write(out)
+}
+
+// resolve answers req as the handler does TCP queries, for the client of r.
+func (d *DoHServer) resolve(r *http.Request, req *dns.Msg) *dns.Msg {
+	w := &dohResponseWriter{remote: &net.TCPAddr{IP: d.clientIP(r)}}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = addr
+	}
+	d.handler.DoTCP(w, req)
+	return w.msg
+}
+
+// clientIP is the address of the client of r: the peer, or if the peer is a
+// trusted proxy, the last address of X-Forwarded-For it didn't add itself.
+func (d *DoHServer) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && d.trusted(ip); i-- {
+		next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if next == nil {
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+func (d *DoHServer) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range d.proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// minTTL is the smallest TTL of the records of m, how long HTTP caches may
+// keep it.
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// dohResponseWriter keeps the response of the handler for the HTTP one.
+type dohResponseWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	if w.local == nil {
+		return &net.TCPAddr{}
+	}
+	return w.local
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+/*
+JSON API, as served by Google and Cloudflare
+*/
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonResponse struct {
+	Status    int            `json:"Status"`
+	TC        bool           `json:"TC"`
+	RD        bool           `json:"RD"`
+	RA        bool           `json:"RA"`
+	AD        bool           `json:"AD"`
+	CD        bool           `json:"CD"`
+	Question  []jsonQuestion `json:"Question"`
+	Answer    []jsonRR       `json:"Answer,omitempty"`
+	Authority []jsonRR       `json:"Authority,omitempty"`
+}
+
+func (d *DoHServer) serveJSON(w http.ResponseWriter, r *http.Request) {
+	req, err := parseJSONQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m := d.resolve(r, req)
+	if m == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonResponse{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+	for _, q := range m.Question {
+		resp.Question = append(resp.Question, jsonQuestion{q.Name, q.Qtype})
+	}
+	resp.Answer = jsonRRs(m.Answer)
+	resp.Authority = jsonRRs(m.Ns)
+
+	w.Header().Set("Content-Type", dnsJSONType)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(m))))
+	json.NewEncoder(w).Encode(resp)
+}
+
+func parseJSONQuery(r *http.Request) (*dns.Msg, error) {
+	q := r.URL.Query()
+	name := q.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = n
+		} else {
+			return nil, fmt.Errorf("invalid type %q", t)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	var err error
+	flag := func(param string) (bool, error) {
+		v := q.Get(param)
+		if v == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s %q", param, v)
+		}
+		return b, nil
+	}
+	if req.CheckingDisabled, err = flag("cd"); err != nil {
+		return nil, err
+	}
+	do, err := flag("do")
+	if err != nil {
+		return nil, err
+	}
+	if do {
+		req.SetEdns0(defaultEDNS0Size, true)
+	}
+	return req, nil
+}
+
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	var out []jsonRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		data := strings.TrimPrefix(rr.String(), h.String())
+		out = append(out, jsonRR{h.Name, h.Rrtype, h.Ttl, data})
+	}
+	return out
+}
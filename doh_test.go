@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDoHServer(t *testing.T) {
+	var queries int64
+	_, upstream := newTestUpstream(t, answerA(60, &queries))
+	h := newTestHandler(upstream)
+	doh, err := NewDoHServer(h, ServerHTTPSSettings{JSON: true, TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(doh)
+	defer srv.Close()
+
+	query := func() []byte {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		buf, _ := req.Pack()
+		return buf
+	}
+	answer := func(resp *http.Response) *dns.Msg {
+		So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		So(resp.Header.Get("Content-Type"), ShouldEqual, "application/dns-message")
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		m := new(dns.Msg)
+		So(m.Unpack(body), ShouldBeNil)
+		return m
+	}
+
+	Convey("DNS over HTTPS listener", t, func() {
+		Convey("Should answer GET queries", func() {
+			resp, err := http.Get(srv.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query()))
+			So(err, ShouldBeNil)
+			m := answer(resp)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(resp.Header.Get("Cache-Control"), ShouldStartWith, "max-age=")
+		})
+
+		Convey("Should answer POST queries", func() {
+			resp, err := http.Post(srv.URL+"/dns-query", "application/dns-message", bytes.NewReader(query()))
+			So(err, ShouldBeNil)
+			So(answer(resp).Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("Should answer the JSON API", func() {
+			resp, err := http.Get(srv.URL + "/dns-query?name=www.example.com&type=A")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/dns-json")
+			var r jsonResponse
+			So(json.NewDecoder(resp.Body).Decode(&r), ShouldBeNil)
+			resp.Body.Close()
+			So(r.Status, ShouldEqual, dns.RcodeSuccess)
+			So(r.Question, ShouldResemble, []jsonQuestion{{"www.example.com.", dns.TypeA}})
+			So(r.Answer, ShouldHaveLength, 1)
+			So(r.Answer[0].Data, ShouldEqual, "192.0.2.1")
+		})
+
+		Convey("Should refuse invalid requests", func() {
+			resp, err := http.Post(srv.URL+"/dns-query", "text/plain", bytes.NewReader(query()))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnsupportedMediaType)
+
+			resp, err = http.Get(srv.URL + "/dns-query?dns=garbage")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			resp, err = http.Get(srv.URL + "/dns-query?name=www.example.com&type=BOGUS")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			req, _ := http.NewRequest(http.MethodPut, srv.URL+"/dns-query", nil)
+			resp, err = http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+
+			resp, err = http.Get(srv.URL + "/other")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Should only believe X-Forwarded-For from trusted proxies", func() {
+			clientIP := func(peer string, forwarded ...string) string {
+				r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+				r.RemoteAddr = peer + ":4242"
+				for _, f := range forwarded {
+					r.Header.Add("X-Forwarded-For", f)
+				}
+				return doh.clientIP(r).String()
+			}
+			So(clientIP("192.0.2.7"), ShouldEqual, "192.0.2.7")
+			So(clientIP("192.0.2.7", "198.51.100.1"), ShouldEqual, "192.0.2.7")
+			So(clientIP("127.0.0.1", "198.51.100.1"), ShouldEqual, "198.51.100.1")
+			So(clientIP("127.0.0.1", "203.0.113.9, 198.51.100.1, 10.1.2.3"), ShouldEqual, "198.51.100.1")
+			So(clientIP("127.0.0.1", "203.0.113.9", "10.1.2.3"), ShouldEqual, "203.0.113.9")
+			So(clientIP("127.0.0.1", "garbage"), ShouldEqual, "127.0.0.1")
+		})
+
+		Convey("Should reject invalid trusted proxies", func() {
+			_, err := NewDoHServer(h, ServerHTTPSSettings{TrustedProxies: []string{"proxy.example.com"}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDoHServerTLS(t *testing.T) {
+	var queries int64
+	_, upstream := newTestUpstream(t, answerA(60, &queries))
+	doh, err := NewDoHServer(newTestHandler(upstream), ServerHTTPSSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCert(t)
+	certs, err := NewCertReloader(cert.caFile, cert.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(doh)
+	srv.EnableHTTP2 = true
+	srv.TLS = certs.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	Convey("DNS over HTTPS listener over TLS", t, func() {
+		Convey("Should answer DNS over HTTPS upstreams", func() {
+			u, err := NewUpstream(strings.Replace(srv.URL, "127.0.0.1", "dns.test", 1)+
+				"/dns-query?bootstrap=127.0.0.1&ca="+url.QueryEscape(cert.caFile), 2*time.Second)
+			So(err, ShouldBeNil)
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			r, _, err := u.Exchange(req)
+			So(err, ShouldBeNil)
+			So(r.Id, ShouldEqual, req.Id)
+			So(r.Answer, ShouldHaveLength, 1)
+			So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+		})
+	})
+}
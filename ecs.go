@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Bound on the number of questions ECSScopes remembers a scope for.
+const maxECSScopes = 65536
+
+// queryVariant returns what, besides the question, decides which response
+// a query gets: the DO and CD bits, and the client subnet if any. Queries
+// without any of them get an empty variant, so their keys are unchanged.
+func queryVariant(req *dns.Msg, subnet string) string {
+	var flags []string
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		flags = append(flags, "do")
+	}
+	if req.CheckingDisabled {
+		flags = append(flags, "cd")
+	}
+	if subnet != "" {
+		flags = append(flags, "ecs="+subnet)
+	}
+	return strings.Join(flags, " ")
+}
+
+// clientSubnet returns the EDNS Client Subnet option of msg, if any.
+func clientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// subnetKey returns the client subnet of e truncated to prefix bits, as
+// used in cache keys. A zero prefix means the answer holds for everyone.
+func subnetKey(e *dns.EDNS0_SUBNET, prefix uint8) string {
+	if prefix == 0 {
+		return ""
+	}
+	if prefix > e.SourceNetmask {
+		// We only know as many bits of the client address as it sent.
+		prefix = e.SourceNetmask
+	}
+	bits := 32
+	if e.Family == 2 {
+		bits = 128
+	}
+	ip := e.Address.Mask(net.CIDRMask(int(prefix), bits))
+	return ip.String() + "/" + strconv.Itoa(int(prefix))
+}
+
+// ECSScopes remembers, per question, the scope prefix the upstreams
+// answered EDNS Client Subnet queries with (RFC 7871), so that an answer
+// is only reused for clients in the subnet it was scoped to.
+type ECSScopes struct {
+	mu     sync.RWMutex
+	scopes map[string]uint8
+}
+
+func NewECSScopes() *ECSScopes {
+	return &ECSScopes{scopes: make(map[string]uint8)}
+}
+
+func (s *ECSScopes) scopeKey(Q Question, e *dns.EDNS0_SUBNET) string {
+	return Q.String() + " " + strconv.Itoa(int(e.Family))
+}
+
+// RequestKey returns the cache key to look req up with.
+func (s *ECSScopes) RequestKey(Q Question, req *dns.Msg) string {
+	e := clientSubnet(req)
+	if e == nil {
+		return KeyGen(Q, queryVariant(req, ""))
+	}
+
+	s.mu.RLock()
+	scope, ok := s.scopes[s.scopeKey(Q, e)]
+	s.mu.RUnlock()
+	if !ok {
+		scope = e.SourceNetmask
+	}
+	return KeyGen(Q, queryVariant(req, subnetKey(e, scope)))
+}
+
+// ResponseKey returns the cache key to store the response to req under,
+// taking the scope from the ECS option of resp.
+func (s *ECSScopes) ResponseKey(Q Question, req, resp *dns.Msg) string {
+	e := clientSubnet(req)
+	if e == nil {
+		return KeyGen(Q, queryVariant(req, ""))
+	}
+
+	// An upstream ignoring ECS answers the same for everyone.
+	var scope uint8
+	if re := clientSubnet(resp); re != nil {
+		scope = re.SourceScope
+	}
+
+	s.mu.Lock()
+	if len(s.scopes) >= maxECSScopes {
+		s.scopes = make(map[string]uint8)
+	}
+	s.scopes[s.scopeKey(Q, e)] = scope
+	s.mu.Unlock()
+
+	return KeyGen(Q, queryVariant(req, subnetKey(e, scope)))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newECSQuery(qname string, addr string, source uint8) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), dns.TypeA)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: source,
+		Address:       net.ParseIP(addr).To4(),
+	})
+	return m
+}
+
+func TestCacheKeyVariant(t *testing.T) {
+	Convey("DNSSEC bits should change the cache key", t, func() {
+		Q := Question{"www.example.com", "A", "IN"}
+		ecs := NewECSScopes()
+
+		plain := new(dns.Msg)
+		plain.SetQuestion("www.example.com.", dns.TypeA)
+		So(ecs.RequestKey(Q, plain), ShouldEqual, KeyGen(Q, ""))
+
+		do := plain.Copy()
+		do.SetEdns0(4096, true)
+		So(ecs.RequestKey(Q, do), ShouldNotEqual, KeyGen(Q, ""))
+
+		cd := plain.Copy()
+		cd.CheckingDisabled = true
+		So(ecs.RequestKey(Q, cd), ShouldNotEqual, KeyGen(Q, ""))
+		So(ecs.RequestKey(Q, cd), ShouldNotEqual, ecs.RequestKey(Q, do))
+	})
+}
+
+func TestECSScopes(t *testing.T) {
+	Convey("ECS answers should only be reused within their scope", t, func() {
+		Q := Question{"www.example.com", "A", "IN"}
+		ecs := NewECSScopes()
+
+		req := newECSQuery("www.example.com", "192.0.2.1", 24)
+		resp := req.Copy()
+		clientSubnet(resp).SourceScope = 16
+		key := ecs.ResponseKey(Q, req, resp)
+
+		So(ecs.RequestKey(Q, newECSQuery("www.example.com", "192.0.99.1", 24)), ShouldEqual, key)
+		So(ecs.RequestKey(Q, newECSQuery("www.example.com", "198.51.100.1", 24)), ShouldNotEqual, key)
+
+		Convey("A zero scope answer is good for everyone", func() {
+			clientSubnet(resp).SourceScope = 0
+			key := ecs.ResponseKey(Q, req, resp)
+			So(ecs.RequestKey(Q, newECSQuery("www.example.com", "198.51.100.1", 24)), ShouldEqual, key)
+		})
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Default EDNS0 UDP buffer size, small enough to get through without IP
+// fragmentation (DNS flag day 2020).
+const defaultEDNS0Size = 1232
+
+// takeOPT removes the OPT record from the additional section of m and
+// returns it, if any.
+func takeOPT(m *dns.Msg) *dns.OPT {
+	var opt *dns.OPT
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			opt = o
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	m.Extra = extra
+	return opt
+}
+
+func newOPT(size uint16, do bool) *dns.OPT {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(size)
+	opt.SetDo(do)
+	return opt
+}
+
+// upstreamQuery returns the query to send upstream for req, leaving req
+// alone. EDNS0 is hop by hop: the OPT record of the client isn't forwarded,
+// the query gets one of ours, advertising size, if the client sent one or
+// force is set. It only sets DO if the client did, and carries the client
+// subnet option over, see ECSScopes.
+func upstreamQuery(req *dns.Msg, size uint16, force bool) *dns.Msg {
+	m := req.Copy()
+	client := takeOPT(m)
+	if client == nil && !force {
+		return m
+	}
+
+	opt := newOPT(size, client != nil && client.Do())
+	if e := clientSubnet(req); e != nil {
+		opt.Option = append(opt.Option, e)
+	}
+	m.Extra = append(m.Extra, opt)
+	return m
+}
+
+// replyEDNS0 replaces the OPT record of resp, a response to req from the
+// cache or upstream, with one of ours, advertising size, if the client
+// sent one, and drops it otherwise (RFC 6891). The DO bit follows the
+// client, and so does the client subnet option: it is echoed back with the
+// scope the upstream answered with, zero if it ignored the option.
+func replyEDNS0(req *dns.Msg, resp *dns.Msg, size uint16) {
+	upstream := takeOPT(resp)
+	client := req.IsEdns0()
+	if client == nil {
+		if resp.Rcode > 0xF {
+			// extended rcodes can't be told to a client without EDNS0
+			resp.Rcode = dns.RcodeServerFailure
+		}
+		return
+	}
+
+	opt := newOPT(size, client.Do())
+	if e := clientSubnet(req); e != nil {
+		// The address and source prefix are the client's own (RFC 7871
+		// 7.2.1), the response may have been cached for another client.
+		echo := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        e.Family,
+			SourceNetmask: e.SourceNetmask,
+			Address:       e.Address,
+		}
+		if upstream != nil {
+			for _, o := range upstream.Option {
+				if u, ok := o.(*dns.EDNS0_SUBNET); ok {
+					echo.SourceScope = u.SourceScope
+				}
+			}
+		}
+		opt.Option = append(opt.Option, echo)
+	}
+	resp.Extra = append(resp.Extra, opt)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUpstreamQuery(t *testing.T) {
+	Convey("Queries should be forwarded with an OPT record of our own", t, func() {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(65535, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option,
+			&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()})
+
+		m := upstreamQuery(req, 1232, false)
+		So(m.IsEdns0().UDPSize(), ShouldEqual, 1232)
+		So(m.IsEdns0().Do(), ShouldEqual, false)
+		So(len(m.IsEdns0().Option), ShouldEqual, 1)
+		So(clientSubnet(m), ShouldNotBeNil)
+
+		Convey("The client query should be left untouched", func() {
+			So(req.IsEdns0().UDPSize(), ShouldEqual, 65535)
+			So(len(req.IsEdns0().Option), ShouldEqual, 2)
+		})
+
+		Convey("DO should only be set if the client asked for it", func() {
+			req.IsEdns0().SetDo()
+			So(upstreamQuery(req, 1232, false).IsEdns0().Do(), ShouldEqual, true)
+		})
+
+		Convey("Queries without EDNS0 only get it if forced", func() {
+			plain := new(dns.Msg)
+			plain.SetQuestion("www.example.com.", dns.TypeA)
+			So(upstreamQuery(plain, 1232, false).IsEdns0(), ShouldBeNil)
+
+			opt := upstreamQuery(plain, 1232, true).IsEdns0()
+			So(opt, ShouldNotBeNil)
+			So(opt.Do(), ShouldEqual, false)
+			So(plain.IsEdns0(), ShouldBeNil)
+		})
+	})
+}
+
+func TestReplyEDNS0(t *testing.T) {
+	Convey("Responses should carry an OPT record only for EDNS0 clients", t, func() {
+		upstream := new(dns.Msg)
+		upstream.SetQuestion("www.example.com.", dns.TypeA)
+		upstream.SetEdns0(4096, true)
+		upstream.IsEdns0().Option = append(upstream.IsEdns0().Option,
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 16, Address: net.ParseIP("192.0.2.0").To4()})
+
+		plain := new(dns.Msg)
+		plain.SetQuestion("www.example.com.", dns.TypeA)
+		resp := upstream.Copy()
+		replyEDNS0(plain, resp, 1232)
+		So(resp.IsEdns0(), ShouldBeNil)
+
+		edns := plain.Copy()
+		edns.SetEdns0(1400, false)
+		resp = upstream.Copy()
+		replyEDNS0(edns, resp, 1232)
+		So(resp.IsEdns0().UDPSize(), ShouldEqual, 1232)
+		So(resp.IsEdns0().Do(), ShouldEqual, false)
+		So(len(resp.IsEdns0().Option), ShouldEqual, 0)
+
+		Convey("The client subnet should be echoed with the upstream scope", func() {
+			edns.IsEdns0().Option = append(edns.IsEdns0().Option,
+				&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 20, Address: net.ParseIP("192.0.16.0").To4()})
+			resp = upstream.Copy()
+			replyEDNS0(edns, resp, 1232)
+			e := clientSubnet(resp)
+			So(e.SourceScope, ShouldEqual, 16)
+			So(e.SourceNetmask, ShouldEqual, 20)
+			So(e.Address.String(), ShouldEqual, "192.0.16.0")
+
+			Convey("With a zero scope if the upstream ignored it", func() {
+				resp = upstream.Copy()
+				resp.IsEdns0().Option = nil
+				replyEDNS0(edns, resp, 1232)
+				So(clientSubnet(resp).SourceScope, ShouldEqual, 0)
+				So(clientSubnet(resp).Address.String(), ShouldEqual, "192.0.16.0")
+			})
+		})
+
+		Convey("Extended rcodes should not reach clients without EDNS0", func() {
+			resp = upstream.Copy()
+			resp.Rcode = dns.RcodeBadCookie
+			replyEDNS0(plain, resp, 1232)
+			So(resp.Rcode, ShouldEqual, dns.RcodeServerFailure)
+			_, err := resp.Pack()
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestHandlerClientSubnet(t *testing.T) {
+	Convey("Cached answers should echo the subnet of the client they are served to", t, func() {
+		var queries int64
+		upstream, addr := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt64(&queries, 1)
+			m := new(dns.Msg)
+			m.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+			m.SetEdns0(1232, false)
+			if e := clientSubnet(req); e != nil {
+				// valid for the whole /16
+				m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code: dns.EDNS0SUBNET, Family: e.Family, SourceNetmask: e.SourceNetmask, SourceScope: 16, Address: e.Address})
+			}
+			w.WriteMsg(m)
+		})
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+
+		ask := func(subnet string) *dns.EDNS0_SUBNET {
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			req.SetEdns0(1232, false)
+			req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4()})
+			w := new(testResponseWriter)
+			h.DoUDP(w, req)
+			So(w.last().Answer, ShouldHaveLength, 1)
+			return clientSubnet(w.last())
+		}
+
+		e := ask("192.0.2.0")
+		So(e.Address.String(), ShouldEqual, "192.0.2.0")
+
+		e = ask("192.0.77.0")
+		So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+		So(e.Address.String(), ShouldEqual, "192.0.77.0")
+		So(e.SourceNetmask, ShouldEqual, 24)
+		So(e.SourceScope, ShouldEqual, 16)
+	})
+}
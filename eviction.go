@@ -0,0 +1,359 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// evictionPolicy tracks the keys of a bounded cache and decides which of
+// them has to go when a new one is added. Implementations are not safe for
+// concurrent use, the cache serializes access to them.
+type evictionPolicy interface {
+	// Add records a newly stored key and returns the key evicted to make
+	// room for it, if any.
+	Add(key string) (victim string, evicted bool)
+	// Evict picks a key to make room, e.g. because the cache holds too
+	// many bytes, and forgets it. ok is false if there is none.
+	Evict() (victim string, ok bool)
+	// Access records a cache hit on key.
+	Access(key string)
+	// Remove forgets key, e.g. because it expired.
+	Remove(key string)
+}
+
+func newEvictionPolicy(name string, capacity int) (evictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return newLRUPolicy(capacity), nil
+	case "lfu":
+		return newLFUPolicy(capacity), nil
+	case "arc":
+		return newARCPolicy(capacity), nil
+	}
+	return nil, fmt.Errorf("invalid cache eviction policy %s", name)
+}
+
+/*
+Least recently used
+*/
+
+type lruPolicy struct {
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRUPolicy(capacity int) *lruPolicy {
+	return &lruPolicy{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Add(key string) (string, bool) {
+	if e, ok := p.items[key]; ok {
+		p.ll.MoveToFront(e)
+		return "", false
+	}
+	p.items[key] = p.ll.PushFront(key)
+	if p.ll.Len() <= p.capacity {
+		return "", false
+	}
+
+	return p.Evict()
+}
+
+func (p *lruPolicy) Evict() (string, bool) {
+	e := p.ll.Back()
+	if e == nil {
+		return "", false
+	}
+	victim := p.ll.Remove(e).(string)
+	delete(p.items, victim)
+	return victim, true
+}
+
+func (p *lruPolicy) Access(key string) {
+	if e, ok := p.items[key]; ok {
+		p.ll.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if e, ok := p.items[key]; ok {
+		p.ll.Remove(e)
+		delete(p.items, key)
+	}
+}
+
+/*
+Least frequently used, ties broken by recency
+*/
+
+type lfuEntry struct {
+	key   string
+	freq  uint64
+	seq   uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].freq < h[j].freq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+type lfuPolicy struct {
+	capacity int
+	seq      uint64
+	heap     lfuHeap
+	items    map[string]*lfuEntry
+}
+
+func newLFUPolicy(capacity int) *lfuPolicy {
+	return &lfuPolicy{
+		capacity: capacity,
+		items:    make(map[string]*lfuEntry),
+	}
+}
+
+func (p *lfuPolicy) Add(key string) (string, bool) {
+	if _, ok := p.items[key]; ok {
+		p.Access(key)
+		return "", false
+	}
+
+	var victim string
+	var evicted bool
+	if len(p.heap) >= p.capacity {
+		victim, evicted = p.Evict()
+	}
+
+	p.seq++
+	e := &lfuEntry{key: key, freq: 1, seq: p.seq}
+	heap.Push(&p.heap, e)
+	p.items[key] = e
+	return victim, evicted
+}
+
+func (p *lfuPolicy) Evict() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	e := heap.Pop(&p.heap).(*lfuEntry)
+	delete(p.items, e.key)
+	return e.key, true
+}
+
+func (p *lfuPolicy) Access(key string) {
+	if e, ok := p.items[key]; ok {
+		p.seq++
+		e.freq++
+		e.seq = p.seq
+		heap.Fix(&p.heap, e.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if e, ok := p.items[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.items, key)
+	}
+}
+
+/*
+Adaptive replacement cache, as described by Megiddo and Modha.
+t1 and t2 hold the resident keys seen once and at least twice, b1 and b2
+are ghost lists remembering keys recently evicted from them. p is the
+adaptive target size of t1.
+*/
+
+const (
+	arcT1 = iota
+	arcT2
+	arcB1
+	arcB2
+)
+
+type arcEntry struct {
+	key  string
+	list int
+}
+
+type arcPolicy struct {
+	capacity int
+	p        int
+	lists    [4]*list.List
+	items    map[string]*list.Element
+}
+
+func newARCPolicy(capacity int) *arcPolicy {
+	a := &arcPolicy{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+	}
+	for i := range a.lists {
+		a.lists[i] = list.New()
+	}
+	return a
+}
+
+func (a *arcPolicy) len(l int) int {
+	return a.lists[l].Len()
+}
+
+func (a *arcPolicy) push(key string, l int) {
+	a.items[key] = a.lists[l].PushFront(&arcEntry{key, l})
+}
+
+func (a *arcPolicy) unlink(e *list.Element) *arcEntry {
+	entry := e.Value.(*arcEntry)
+	a.lists[entry.list].Remove(e)
+	delete(a.items, entry.key)
+	return entry
+}
+
+// dropLRU forgets the least recently used key of list l.
+func (a *arcPolicy) dropLRU(l int) {
+	if e := a.lists[l].Back(); e != nil {
+		a.unlink(e)
+	}
+}
+
+// replace demotes the least recently used key of t1 or t2 to its ghost
+// list and returns it as the evicted key, if the cache is full.
+func (a *arcPolicy) replace(inB2 bool) (string, bool) {
+	if a.len(arcT1)+a.len(arcT2) < a.capacity {
+		return "", false
+	}
+	return a.demote(inB2)
+}
+
+func (a *arcPolicy) demote(inB2 bool) (string, bool) {
+	if a.len(arcT1)+a.len(arcT2) == 0 {
+		return "", false
+	}
+
+	from, ghost := arcT2, arcB2
+	t1 := a.len(arcT1)
+	if t1 > 0 && (t1 > a.p || (inB2 && t1 == a.p) || a.len(arcT2) == 0) {
+		from, ghost = arcT1, arcB1
+	}
+
+	entry := a.unlink(a.lists[from].Back())
+	a.push(entry.key, ghost)
+	return entry.key, true
+}
+
+func (a *arcPolicy) Add(key string) (string, bool) {
+	e, ok := a.items[key]
+	if !ok {
+		return a.miss(key)
+	}
+
+	var victim string
+	var evicted bool
+	switch entry := e.Value.(*arcEntry); entry.list {
+	case arcT1, arcT2:
+		a.Access(key)
+		return "", false
+	case arcB1:
+		delta := a.len(arcB2) / a.len(arcB1)
+		if delta < 1 {
+			delta = 1
+		}
+		if a.p += delta; a.p > a.capacity {
+			a.p = a.capacity
+		}
+		victim, evicted = a.replace(false)
+	case arcB2:
+		delta := a.len(arcB1) / a.len(arcB2)
+		if delta < 1 {
+			delta = 1
+		}
+		if a.p -= delta; a.p < 0 {
+			a.p = 0
+		}
+		victim, evicted = a.replace(true)
+	}
+
+	a.unlink(e)
+	a.push(key, arcT2)
+	return victim, evicted
+}
+
+func (a *arcPolicy) miss(key string) (string, bool) {
+	var victim string
+	var evicted bool
+
+	l1 := a.len(arcT1) + a.len(arcB1)
+	total := l1 + a.len(arcT2) + a.len(arcB2)
+	switch {
+	case l1 >= a.capacity:
+		if a.len(arcT1) < a.capacity {
+			a.dropLRU(arcB1)
+			victim, evicted = a.replace(false)
+		} else {
+			victim, evicted = a.unlink(a.lists[arcT1].Back()).key, true
+		}
+	case total >= a.capacity:
+		if total >= 2*a.capacity {
+			a.dropLRU(arcB2)
+		}
+		victim, evicted = a.replace(false)
+	}
+
+	a.push(key, arcT1)
+	return victim, evicted
+}
+
+func (a *arcPolicy) Evict() (string, bool) {
+	return a.demote(false)
+}
+
+func (a *arcPolicy) Access(key string) {
+	e, ok := a.items[key]
+	if !ok {
+		return
+	}
+	if l := e.Value.(*arcEntry).list; l == arcT1 || l == arcT2 {
+		a.unlink(e)
+		a.push(key, arcT2)
+	}
+}
+
+func (a *arcPolicy) Remove(key string) {
+	if e, ok := a.items[key]; ok {
+		if l := e.Value.(*arcEntry).list; l == arcT1 || l == arcT2 {
+			a.unlink(e)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLRUPolicy(t *testing.T) {
+	Convey("LRU should evict the least recently used key", t, func() {
+		p := newLRUPolicy(2)
+		p.Add("a")
+		p.Add("b")
+		p.Access("a")
+
+		victim, evicted := p.Add("c")
+		So(evicted, ShouldEqual, true)
+		So(victim, ShouldEqual, "b")
+
+		p.Remove("a")
+		_, evicted = p.Add("d")
+		So(evicted, ShouldEqual, false)
+	})
+}
+
+func TestLFUPolicy(t *testing.T) {
+	Convey("LFU should evict the least frequently used key", t, func() {
+		p := newLFUPolicy(2)
+		p.Add("a")
+		p.Add("b")
+		p.Access("a")
+		p.Access("b")
+		p.Access("b")
+
+		victim, evicted := p.Add("c")
+		So(evicted, ShouldEqual, true)
+		So(victim, ShouldEqual, "a")
+
+		Convey("Ties should be broken by recency", func() {
+			victim, _ = p.Add("d")
+			So(victim, ShouldEqual, "c")
+		})
+	})
+}
+
+func TestARCPolicy(t *testing.T) {
+	Convey("ARC should protect frequently used keys from a scan", t, func() {
+		p := newARCPolicy(3)
+		p.Add("hot")
+		p.Access("hot")
+
+		for i := 0; i < 10; i++ {
+			victim, _ := p.Add("scan" + strconv.Itoa(i))
+			So(victim, ShouldNotEqual, "hot")
+		}
+
+		Convey("Resident keys should never exceed the capacity", func() {
+			So(p.len(arcT1)+p.len(arcT2), ShouldEqual, 3)
+			So(p.len(arcB1)+p.len(arcB2), ShouldBeLessThanOrEqualTo, 3)
+		})
+	})
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	Convey("A full memory cache should evict instead of refusing entries", t, func() {
+		cache, err := NewMemoryCache(2, 0, "lru", 0, 0)
+		So(err, ShouldBeNil)
+
+		cache.Set("a", newTestMsg("a.example.com", 300), time.Minute)
+		cache.Set("b", newTestMsg("b.example.com", 300), time.Minute)
+		cache.Get("a")
+		So(cache.Set("c", newTestMsg("c.example.com", 300), time.Minute), ShouldBeNil)
+
+		So(cache.Length(), ShouldEqual, 2)
+		So(cache.Exists("a"), ShouldEqual, true)
+		So(cache.Exists("b"), ShouldEqual, false)
+		So(cache.Evicted(), ShouldEqual, 1)
+
+		Convey("Sweep should drop expired entries", func() {
+			cache.Set("d", newTestMsg("d.example.com", 300), -time.Second)
+			So(cache.Sweep(), ShouldEqual, 1)
+			So(cache.Exists("d"), ShouldEqual, false)
+			So(cache.Expired(), ShouldEqual, 1)
+		})
+
+		Convey("An unknown policy should be rejected", func() {
+			_, err := NewMemoryCache(2, 0, "fifo", 0, 0)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMemoryCacheConcurrentHits(t *testing.T) {
+	Convey("Hits should record accesses while other goroutines write", t, func() {
+		msg := newTestMsg("a.example.com", 300)
+		for _, policy := range []string{"lru", "lfu", "arc"} {
+			cache, err := NewMemoryCache(16, 0, policy, 0, 0)
+			So(err, ShouldBeNil)
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 500; i++ {
+						key := strconv.Itoa((g*7 + i) % 32)
+						switch i % 4 {
+						case 0:
+							cache.Set(key, msg, time.Minute)
+						case 3:
+							cache.Remove(key)
+						default:
+							cache.Get(key)
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			So(cache.Length(), ShouldBeLessThanOrEqualTo, 16)
+			for i := 0; i < 32; i++ {
+				So(cache.Set("new"+strconv.Itoa(i), msg, time.Minute), ShouldBeNil)
+			}
+			So(cache.Length(), ShouldEqual, 16)
+		}
+	})
+}
+
+func TestMemoryCacheMaxMemory(t *testing.T) {
+	Convey("A memory cache should stay within its memory budget", t, func() {
+		small := newTestMsg("a.example.com", 300)
+		large := newTestMsg("large.example.com", 300)
+		for i := 0; i < 50; i++ {
+			rr, _ := dns.NewRR(`large.example.com. 300 IN TXT "` + strings.Repeat("x", 200) + `"`)
+			large.Answer = append(large.Answer, rr)
+		}
+		budget := 4 * entrySize("a", Mesg{Msg: small})
+
+		for _, policy := range []string{"lru", "lfu", "arc"} {
+			cache, err := NewMemoryCache(0, budget, policy, 0, 0)
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 10; i++ {
+				So(cache.Set(strconv.Itoa(i), small, time.Minute), ShouldBeNil)
+				So(cache.Stats().Bytes, ShouldBeLessThanOrEqualTo, budget)
+			}
+			So(cache.Length(), ShouldEqual, 4)
+			So(cache.Evicted(), ShouldEqual, 6)
+			So(cache.Full(), ShouldEqual, true)
+
+			Convey("Entries larger than the budget should be refused with "+policy, func() {
+				So(cache.Set("large", large, time.Minute), ShouldHaveSameTypeAs, CacheIsFull{})
+				So(cache.Stats().FullRejections, ShouldEqual, 1)
+				So(cache.Length(), ShouldEqual, 4)
+			})
+
+			Convey("New entries should be kept over popular ones with "+policy, func() {
+				for i := 6; i < 10; i++ {
+					cache.Get(strconv.Itoa(i))
+					cache.Get(strconv.Itoa(i))
+				}
+				So(cache.Set("n", small, time.Minute), ShouldBeNil)
+				_, err := cache.Get("n")
+				So(err, ShouldBeNil)
+				So(cache.Length(), ShouldEqual, 4)
+				So(cache.Stats().Bytes, ShouldBeLessThanOrEqualTo, budget)
+
+				Convey("And replaced in place with "+policy, func() {
+					So(cache.Set("n", small, time.Minute), ShouldBeNil)
+					_, err := cache.Get("n")
+					So(err, ShouldBeNil)
+					So(cache.Length(), ShouldEqual, 4)
+				})
+			})
+		}
+	})
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"net"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -23,18 +26,31 @@ func (q *Question) String() string {
 	return q.qname + " " + q.qclass + " " + q.qtype
 }
 
+// GODNSHandler keeps three caches: cache for answers, negCache for NXDOMAIN
+// and NODATA responses, which are replayed verbatim, and failCache, which
+// briefly remembers upstream failures and answers them with SERVFAIL.
+// When prefetch is enabled, prefetcher picks popular answers to refresh
+// before they expire. rules override the cache policy of some domains.
 type GODNSHandler struct {
-	resolver        *Resolver
-	cache, negCache Cache
-	hosts           Hosts
+	// accessed atomically, keep it first for 64-bit alignment
+	stats handlerStats
+
+	resolver                   *Resolver
+	cache, negCache, failCache Cache
+	hosts                      Hosts
+	prefetcher                 *Prefetcher
+	lookups                    *LookupGroup
+	ecs                        *ECSScopes
+	rules                      *CacheRules
+	invalidator                *Invalidator
 }
 
 func NewHandler() *GODNSHandler {
 
 	var (
-		cacheConfig     CacheSettings
-		resolver        *Resolver
-		cache, negCache Cache
+		cacheConfig                CacheSettings
+		resolver                   *Resolver
+		cache, negCache, failCache Cache
 	)
 
 	resolver = NewResolver(settings.ResolvConfig)
@@ -42,41 +58,103 @@ func NewHandler() *GODNSHandler {
 	cacheConfig = settings.Cache
 	switch cacheConfig.Backend {
 	case "memory":
-		cache = &MemoryCache{
-			Backend:  make(map[string]Mesg, cacheConfig.Maxcount),
-			Expire:   time.Duration(cacheConfig.Expire) * time.Second,
-			Maxcount: cacheConfig.Maxcount,
-		}
-		negCache = &MemoryCache{
-			Backend:  make(map[string]Mesg),
-			Expire:   time.Duration(cacheConfig.Expire) * time.Second / 2,
-			Maxcount: cacheConfig.Maxcount,
-		}
-	case "memcache":
-		cache = NewMemcachedCache(
-			settings.Memcache.Servers,
-			int32(cacheConfig.Expire))
-		negCache = NewMemcachedCache(
-			settings.Memcache.Servers,
-			int32(cacheConfig.Expire/2))
-	case "redis":
-		cache = NewRedisCache(
-			settings.Redis,
-			int64(cacheConfig.Expire))
-		negCache = NewRedisCache(
-			settings.Redis,
-			int64(cacheConfig.Expire/2))
+		cache = newMemoryCache(cacheConfig, cacheConfig.StaleWindowDuration())
+		negCache = newMemoryCache(cacheConfig, 0)
+		failCache = newMemoryCache(cacheConfig, 0)
+	case "memcache", "redis":
+		cache = newRemoteCache(cacheConfig.Backend, "godns:cache:", cacheConfig.StaleWindowDuration())
+		negCache = newRemoteCache(cacheConfig.Backend, "godns:neg:", 0)
+		failCache = newRemoteCache(cacheConfig.Backend, "godns:fail:", 0)
+	case "tiered":
+		l1Config := cacheConfig
+		l1Config.Maxcount = cacheConfig.L1Maxcount
+		cache = NewTieredCache(
+			newMemoryCache(l1Config, cacheConfig.StaleWindowDuration()),
+			newRemoteCache(cacheConfig.L2Backend, "godns:cache:", cacheConfig.StaleWindowDuration()))
+		negCache = NewTieredCache(
+			newMemoryCache(l1Config, 0),
+			newRemoteCache(cacheConfig.L2Backend, "godns:neg:", 0))
+		// Failures are local, a flaky link on one instance shouldn't
+		// SERVFAIL the whole fleet.
+		failCache = newMemoryCache(l1Config, 0)
 	default:
 		logger.Error("Invalid cache backend %s", cacheConfig.Backend)
 		panic("Invalid cache backend")
 	}
 
+	rules, err := NewCacheRules(cacheConfig.Rules)
+	if err != nil {
+		logger.Error("Invalid cache rules: %s", err)
+		panic(err)
+	}
+
 	var hosts Hosts
 	if settings.Hosts.Enable {
 		hosts = NewHosts(settings.Hosts, settings.Redis)
 	}
 
-	return &GODNSHandler{resolver, cache, negCache, hosts}
+	var prefetcher *Prefetcher
+	if cacheConfig.Prefetch {
+		prefetcher = NewPrefetcher(cacheConfig.PrefetchHits, cacheConfig.PrefetchPercent)
+	}
+
+	h := &GODNSHandler{
+		resolver:   resolver,
+		cache:      cache,
+		negCache:   negCache,
+		failCache:  failCache,
+		hosts:      hosts,
+		prefetcher: prefetcher,
+		lookups:    NewLookupGroup(),
+		ecs:        NewECSScopes(),
+		rules:      rules,
+	}
+
+	if channel := cacheConfig.InvalidationChannel; channel != "" {
+		h.invalidator = NewInvalidator(settings.Redis, channel, h.flushLocal)
+		go h.invalidator.Run()
+	}
+
+	if file := cacheConfig.PersistFile; file != "" {
+		if n, err := h.LoadCache(file); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Load cache snapshot %s failed: %s", file, err)
+		} else {
+			logger.Info("Load %d cache entries from %s", n, file)
+		}
+		if interval := cacheConfig.PersistIntervalDuration(); interval > 0 {
+			go h.saveCachePeriodically(file, interval)
+		}
+	}
+
+	return h
+}
+
+func newRemoteCache(backend string, prefix string, stale time.Duration) ExpiringCache {
+	switch backend {
+	case "memcache":
+		return NewMemcachedCache(settings.Memcache.Servers, prefix, stale)
+	case "redis":
+		return NewRedisCache(settings.Redis, prefix, stale)
+	}
+	logger.Error("Invalid shared cache backend %s", backend)
+	panic("Invalid shared cache backend")
+}
+
+func newMemoryCache(cs CacheSettings, stale time.Duration) Cache {
+	var (
+		c   Cache
+		err error
+	)
+	if cs.Shards > 1 {
+		c, err = NewShardedCache(cs.Shards, cs.Maxcount, cs.MaxMemoryBytes(), cs.Eviction, cs.SweepIntervalDuration(), stale)
+	} else {
+		c, err = NewMemoryCache(cs.Maxcount, cs.MaxMemoryBytes(), cs.Eviction, cs.SweepIntervalDuration(), stale)
+	}
+	if err != nil {
+		logger.Error("%s", err)
+		panic(err)
+	}
+	return c
 }
 
 func (h *GODNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
@@ -132,55 +210,294 @@ func (h *GODNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 
-	key := KeyGen(Q)
-	mesg, err := h.cache.Get(key)
-	if err != nil {
-		if mesg, err = h.negCache.Get(key); err != nil {
-			logger.Debug("%s didn't hit cache", Q.String())
-		} else {
-			logger.Debug("%s hit negative cache", Q.String())
+	atomic.AddUint64(&h.stats.queries, 1)
+	key := h.ecs.RequestKey(Q, req)
+	rule, _ := h.rules.Match(Q.qname)
+	if rule.NoCache {
+		logger.Debug("%s is never cached", Q.String())
+		atomic.AddUint64(&h.stats.misses, 1)
+		mesg, err := h.lookup(Net, req, key, Q)
+		if err != nil {
+			logger.Warn("Resolve query error %s", err)
 			dns.HandleFailed(w, req)
 			return
 		}
-	} else {
+		w.WriteMsg(mesg)
+		return
+	}
+
+	mesg, err := h.cache.Get(key)
+	if err == nil {
 		logger.Debug("%s hit cache", Q.String())
-		// we need this copy against concurrent modification of Id
-		msg := *mesg
-		msg.Id = req.Id
-		w.WriteMsg(&msg)
+		atomic.AddUint64(&h.stats.hits, 1)
+		w.WriteMsg(replyFromCache(req, mesg))
+		if h.prefetcher != nil && h.prefetcher.Hit(key) {
+			go h.prefetch(Net, req.Copy(), key, Q)
+		}
 		return
 	}
+	// An expired entry still within the stale window may be served if
+	// the upstreams fail us, see RFC 8767.
+	var stale *dns.Msg
+	if _, ok := err.(KeyExpired); ok && mesg != nil && rule.ServeStale(settings.Cache.ServeStale) {
+		stale = mesg
+	}
 
-	mesg, err = h.resolver.Lookup(Net, req)
+	if mesg, err = h.negCache.Get(key); err == nil {
+		logger.Debug("%s hit negative cache", Q.String())
+		atomic.AddUint64(&h.stats.negHits, 1)
+		w.WriteMsg(replyFromCache(req, mesg))
+		return
+	}
+	if _, err = h.failCache.Get(key); err == nil {
+		logger.Debug("%s hit failure cache", Q.String())
+		atomic.AddUint64(&h.stats.failHits, 1)
+		if stale != nil {
+			h.writeStale(w, req, stale)
+			return
+		}
+		dns.HandleFailed(w, req)
+		return
+	}
+	logger.Debug("%s didn't hit cache", Q.String())
+	atomic.AddUint64(&h.stats.misses, 1)
+
+	var timeout time.Duration
+	if stale != nil {
+		timeout = settings.Cache.ClientTimeoutDuration()
+	}
+	mesg, err = h.resolve(Net, req, key, Q, timeout)
 
 	if err != nil {
 		logger.Warn("Resolve query error %s", err)
+		if stale != nil {
+			h.writeStale(w, req, stale)
+			return
+		}
 		dns.HandleFailed(w, req)
+		return
+	}
+
+	w.WriteMsg(mesg)
+}
+
+// resolve looks req up upstream and caches the outcome. If timeout is set
+// and the upstreams take longer than that, resolve stops waiting and
+// returns a ResolvTimeout; the lookup carries on and refreshes the cache in
+// the background.
+func (h *GODNSHandler) resolve(Net string, req *dns.Msg, key string, Q Question, timeout time.Duration) (*dns.Msg, error) {
+	if timeout <= 0 {
+		return h.lookup(Net, req, key, Q)
+	}
+
+	type result struct {
+		mesg *dns.Msg
+		err  error
+	}
+	done := make(chan result, 1)
+	// req is still used to answer the client if we time out.
+	req = req.Copy()
+	go func() {
+		mesg, err := h.lookup(Net, req, key, Q)
+		done <- result{mesg, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.mesg, r.err
+	case <-time.After(timeout):
+		return nil, ResolvTimeout{Q.qname, timeout}
+	}
+}
+
+// lookup asks the upstreams and caches the outcome. Concurrent lookups of
+// the same question share a single upstream exchange, each caller gets its
+// own copy of the response carrying its own message id.
+func (h *GODNSHandler) lookup(Net string, req *dns.Msg, key string, Q Question) (*dns.Msg, error) {
+	mesg, err, shared := h.lookups.Do(Net+" "+key, func() (*dns.Msg, error) {
+		mesg, err := h.resolver.Lookup(Net, req)
+		if err == nil {
+			// the upstream may have scoped its answer to the client subnet
+			key = h.ecs.ResponseKey(Q, req, mesg)
+		}
+		h.store(key, Q, mesg, err)
+		return mesg, err
+	})
+	if err != nil || !shared {
+		return mesg, err
+	}
+
+	logger.Debug("%s shared an in-flight lookup", Q.String())
+	return replyFromCache(req, mesg.Copy()), nil
+}
+
+// store caches the outcome of an upstream lookup.
+func (h *GODNSHandler) store(key string, Q Question, mesg *dns.Msg, err error) {
+	rule, _ := h.rules.Match(Q.qname)
+	if rule.NoCache {
+		return
+	}
 
+	if err != nil {
 		// cache the failure, too!
-		if err = h.negCache.Set(key, nil); err != nil {
-			logger.Warn("Set %s negative cache failed: %v", Q.String(), err)
+		if ttl := settings.Cache.ServfailTTLDuration(); ttl > 0 {
+			if err = h.failCache.Set(key, nil, ttl); err != nil {
+				logger.Warn("Set %s failure cache failed: %v", Q.String(), err)
+			}
 		}
 		return
 	}
 
-	w.WriteMsg(mesg)
+	if isNegative(mesg) {
+		ttl, ok := negativeTTL(mesg)
+		if !ok {
+			return
+		}
+		if err = h.negCache.Set(key, mesg, settings.Cache.ClampNegTTL(ttl)); err != nil {
+			logger.Warn("Set %s negative cache failed: %v", Q.String(), err)
+		}
+		logger.Debug("Insert %s into negative cache", Q.String())
+		return
+	}
 
 	if len(mesg.Answer) > 0 {
-		err = h.cache.Set(key, mesg)
+		ttl := h.cacheTTL(mesg, rule)
+		if ttl <= 0 {
+			return
+		}
+		err = h.cache.Set(key, mesg, ttl)
 		if err != nil {
 			logger.Warn("Set %s cache failed: %s", Q.String(), err.Error())
+			return
 		}
 		logger.Debug("Insert %s into cache", Q.String())
+		if h.prefetcher != nil {
+			h.prefetcher.Stored(key, ttl)
+		}
+	}
+}
+
+// Flush drops the cached answers, negative answers and failures selected
+// by filter, and has the other instances drop them from their local memory
+// if an invalidation channel is set.
+func (h *GODNSHandler) Flush(filter CacheFilter) error {
+	for _, cache := range []Cache{h.cache, h.negCache, h.failCache} {
+		if err := cache.Flush(filter); err != nil {
+			return err
+		}
+	}
+	logger.Info("Flush cache %+v", filter)
+
+	if h.invalidator != nil {
+		if err := h.invalidator.Publish(filter); err != nil {
+			logger.Warn("Publish cache invalidation failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// flushLocal drops the entries selected by filter from the caches, or cache
+// tiers, held in memory, on behalf of another instance which flushed them.
+// The shared tier was already flushed by that instance.
+func (h *GODNSHandler) flushLocal(filter CacheFilter) {
+	for _, cache := range []Cache{h.cache, h.negCache, h.failCache} {
+		switch c := cache.(type) {
+		case *TieredCache:
+			c.L1.Flush(filter)
+		case *MemoryCache, *ShardedCache:
+			c.Flush(filter)
+		}
+	}
+	logger.Info("Flush local cache %+v", filter)
+}
+
+// prefetch refreshes the cached answer of a popular name before it expires.
+func (h *GODNSHandler) prefetch(Net string, req *dns.Msg, key string, Q Question) {
+	defer h.prefetcher.Done(key)
+
+	logger.Debug("%s prefetch", Q.String())
+	atomic.AddUint64(&h.stats.prefetches, 1)
+	if _, err := h.lookup(Net, req, key, Q); err != nil {
+		logger.Warn("Prefetch %s failed: %s", Q.String(), err)
 	}
 }
 
+func (h *GODNSHandler) writeStale(w dns.ResponseWriter, req *dns.Msg, stale *dns.Msg) {
+	logger.Debug("%s answered with stale cache", UnFqdn(req.Question[0].Name))
+	atomic.AddUint64(&h.stats.stale, 1)
+	w.WriteMsg(replyFromCache(req, staleMsg(stale, settings.Cache.StaleAnswerTTL)))
+}
+
+// replyFromCache turns mesg, a private copy of a response cached for the
+// same question, into the answer to req: it takes the id of req, and the
+// names spelled the way the client did, as some of them check it (0x20).
+func replyFromCache(req *dns.Msg, mesg *dns.Msg) *dns.Msg {
+	mesg.Id = req.Id
+	if len(req.Question) == 0 || len(mesg.Question) == 0 {
+		return mesg
+	}
+
+	cached, qname := mesg.Question[0].Name, req.Question[0].Name
+	if cached == qname || !strings.EqualFold(cached, qname) {
+		return mesg
+	}
+	mesg.Question[0].Name = qname
+	for _, section := range [][]dns.RR{mesg.Answer, mesg.Ns, mesg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Name == cached {
+				hdr.Name = qname
+			}
+		}
+	}
+	return mesg
+}
+
+// cacheTTL returns how long mesg may be cached: the minimum TTL of its
+// answer and authority records, clamped by the min-ttl and max-ttl settings
+// or those of the rule of its domain.
+func (h *GODNSHandler) cacheTTL(mesg *dns.Msg, rule CacheRule) time.Duration {
+	ttl, ok := msgTTL(mesg)
+	if !ok {
+		return settings.Cache.ExpireDuration()
+	}
+	return rule.ClampTTL(settings.Cache, ttl)
+}
+
 func (h *GODNSHandler) DoTCP(w dns.ResponseWriter, req *dns.Msg) {
-	h.do("tcp", w, req)
+	h.do("tcp", &responseWriter{w, req, 0}, req)
 }
 
 func (h *GODNSHandler) DoUDP(w dns.ResponseWriter, req *dns.Msg) {
-	h.do("udp", w, req)
+	h.do("udp", &responseWriter{w, req, udpSize(req)}, req)
+}
+
+// responseWriter fixes responses up for the client of req: their OPT
+// record, see replyEDNS0, and for UDP clients their size, trimming them
+// and setting the TC bit so that the client retries over TCP rather than
+// losing them. Zero size leaves them whole.
+type responseWriter struct {
+	dns.ResponseWriter
+	req  *dns.Msg
+	size int
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	// the handler only writes messages of its own, which may be modified
+	replyEDNS0(w.req, m, settings.ResolvConfig.EDNS0Size())
+	if w.size > 0 {
+		m.Truncate(w.size)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// udpSize is the largest response req may be answered with over UDP: the
+// buffer size of its OPT record, or 512 bytes without one (RFC 6891).
+func udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
 }
 
 func (h *GODNSHandler) isIPQuery(q dns.Question) int {
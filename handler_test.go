@@ -0,0 +1,513 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testResponseWriter records the responses written to it.
+type testResponseWriter struct {
+	msgs []*dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+func (w *testResponseWriter) last() *dns.Msg {
+	if len(w.msgs) == 0 {
+		return nil
+	}
+	return w.msgs[len(w.msgs)-1]
+}
+
+// testUpstream is a nameserver on a local port, over UDP and TCP.
+type testUpstream struct {
+	udp, tcp *dns.Server
+}
+
+func (u *testUpstream) Shutdown() {
+	u.udp.Shutdown()
+	u.tcp.Shutdown()
+}
+
+// newTestUpstream starts a nameserver answering with handler. Shut it down
+// once done.
+func newTestUpstream(t *testing.T, handler dns.HandlerFunc) (*testUpstream, string) {
+	var pc net.PacketConn
+	var l net.Listener
+	var err error
+	// the TCP port of the UDP one may be taken, try a few
+	for i := 0; i < 10; i++ {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &testUpstream{
+		udp: &dns.Server{PacketConn: pc, Handler: handler},
+		tcp: &dns.Server{Listener: l, Handler: handler},
+	}
+	for _, srv := range []*dns.Server{u.udp, u.tcp} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+	}
+	return u, pc.LocalAddr().String()
+}
+
+// answerA answers every query with a single A record of the given TTL,
+// and counts the queries.
+func answerA(ttl uint32, queries *int64) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt64(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " IN A 192.0.2.1")
+		rr.Header().Ttl = ttl
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	}
+}
+
+// newTestHandler returns a handler with unbounded memory caches, asking
+// upstreams. The hosts file is disabled.
+func newTestHandler(upstreams ...string) *GODNSHandler {
+	if logger == nil {
+		logger = NewLogger()
+	}
+	settings.Hosts.Enable = false
+
+	newCache := func() Cache {
+		c, _ := NewMemoryCache(0, 0, "", 0, 0)
+		return c
+	}
+	rules, _ := NewCacheRules(nil)
+	return &GODNSHandler{
+		resolver: &Resolver{
+			servers:       upstreams,
+			domain_server: newSuffixTreeRoot(),
+			config:        &ResolvSettings{Timeout: 1},
+		},
+		cache:     newCache(),
+		negCache:  newCache(),
+		failCache: newCache(),
+		lookups:   NewLookupGroup(),
+		ecs:       NewECSScopes(),
+		rules:     rules,
+	}
+}
+
+func TestHandlerCache(t *testing.T) {
+	Convey("The handler should answer repeated queries from cache", t, func() {
+		var queries int64
+		upstream, addr := newTestUpstream(t, answerA(300, &queries))
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+
+		w := new(testResponseWriter)
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		h.DoUDP(w, req)
+		So(w.last().Rcode, ShouldEqual, dns.RcodeSuccess)
+
+		req.Id++
+		h.DoUDP(w, req)
+		So(len(w.msgs), ShouldEqual, 2)
+		So(w.last().Id, ShouldEqual, req.Id)
+		So(w.last().Answer[0].(*dns.A).A.String(), ShouldEqual, "192.0.2.1")
+		So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+
+		stats := h.Stats()
+		So(stats.Hits, ShouldEqual, 1)
+		So(stats.Misses, ShouldEqual, 1)
+	})
+}
+
+func TestHandlerSharedLookup(t *testing.T) {
+	Convey("Concurrent queries for a name should share one upstream exchange", t, func() {
+		var queries int64
+		answer := answerA(300, &queries)
+		upstream, addr := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			time.Sleep(300 * time.Millisecond)
+			answer(w, req)
+		})
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+
+		const n = 10
+		writers := make([]*testResponseWriter, n)
+		var wg sync.WaitGroup
+		for i := range writers {
+			writers[i] = new(testResponseWriter)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := new(dns.Msg)
+				req.SetQuestion("www.example.com.", dns.TypeA)
+				req.Id = uint16(1000 + i)
+				h.DoUDP(writers[i], req)
+			}(i)
+		}
+		wg.Wait()
+
+		So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+		for i, w := range writers {
+			m := w.last()
+			So(m.Id, ShouldEqual, 1000+i)
+			So(m.Answer, ShouldHaveLength, 1)
+		}
+		// every client got its own copy
+		writers[0].last().Answer[0].Header().Ttl = 1
+		So(writers[1].last().Answer[0].Header().Ttl, ShouldNotEqual, 1)
+	})
+}
+
+func TestHandlerNegativeCache(t *testing.T) {
+	Convey("The handler should replay negative answers and failures from cache", t, func() {
+		var queries int64
+		rcode := int32(dns.RcodeNameError)
+		upstream, addr := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt64(&queries, 1)
+			m := new(dns.Msg)
+			m.SetRcode(req, int(atomic.LoadInt32(&rcode)))
+			if m.Rcode != dns.RcodeServerFailure {
+				soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 60")
+				m.Ns = append(m.Ns, soa)
+			}
+			w.WriteMsg(m)
+		})
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+
+		ask := func(id uint16) *dns.Msg {
+			w := new(testResponseWriter)
+			req := new(dns.Msg)
+			req.SetQuestion("nx.example.com.", dns.TypeA)
+			req.Id = id
+			h.DoUDP(w, req)
+			So(w.last().Id, ShouldEqual, id)
+			return w.last()
+		}
+
+		Convey("NXDOMAIN should be replayed with its SOA", func() {
+			So(ask(1).Rcode, ShouldEqual, dns.RcodeNameError)
+			m := ask(2)
+			So(m.Rcode, ShouldEqual, dns.RcodeNameError)
+			So(m.Ns, ShouldHaveLength, 1)
+			So(m.Ns[0].Header().Rrtype, ShouldEqual, dns.TypeSOA)
+			So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+			So(h.Stats().NegHits, ShouldEqual, 1)
+		})
+
+		Convey("NODATA should be replayed as NODATA", func() {
+			atomic.StoreInt32(&rcode, dns.RcodeSuccess)
+			So(ask(1).Answer, ShouldBeEmpty)
+			m := ask(2)
+			So(m.Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(m.Answer, ShouldBeEmpty)
+			So(m.Ns, ShouldHaveLength, 1)
+			So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+			So(h.Stats().NegHits, ShouldEqual, 1)
+		})
+
+		Convey("Upstream failures should be answered SERVFAIL without asking again", func() {
+			atomic.StoreInt32(&rcode, dns.RcodeServerFailure)
+			So(ask(1).Rcode, ShouldEqual, dns.RcodeServerFailure)
+			So(ask(2).Rcode, ShouldEqual, dns.RcodeServerFailure)
+			So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+			So(h.Stats().FailHits, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestHandlerServeStale(t *testing.T) {
+	Convey("The handler should serve expired answers when the upstreams fail it", t, func() {
+		defer func(cs CacheSettings) { settings.Cache = cs }(settings.Cache)
+		settings.Cache.ServeStale = true
+		settings.Cache.StaleAnswerTTL = 30
+		settings.Cache.ClientTimeout = 1000
+
+		var queries int64
+		var failing int32 = 1
+		answer := answerA(300, &queries)
+		upstream, addr := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			if atomic.LoadInt32(&failing) == 1 {
+				m := new(dns.Msg)
+				m.SetRcode(req, dns.RcodeServerFailure)
+				w.WriteMsg(m)
+				return
+			}
+			// slower than the client timeout
+			time.Sleep(400 * time.Millisecond)
+			answer(w, req)
+		})
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+		h.cache, _ = NewMemoryCache(0, 0, "", 0, time.Hour)
+
+		key := KeyGen(Question{"www.example.com", "A", "IN"}, "")
+		h.cache.Set(key, newTestMsg("www.example.com", 300), -time.Second)
+
+		ask := func(id uint16) *dns.Msg {
+			w := new(testResponseWriter)
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			req.Id = id
+			h.DoUDP(w, req)
+			So(w.last().Id, ShouldEqual, id)
+			return w.last()
+		}
+
+		Convey("Failed lookups should be answered stale", func() {
+			m := ask(1)
+			So(m.Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].Header().Ttl, ShouldEqual, 30)
+			So(h.Stats().Stale, ShouldEqual, 1)
+
+			Convey("Also from the failure cache", func() {
+				m := ask(2)
+				So(m.Answer[0].Header().Ttl, ShouldEqual, 30)
+				So(h.Stats().FailHits, ShouldEqual, 1)
+				So(h.Stats().Stale, ShouldEqual, 2)
+			})
+		})
+
+		Convey("Slow lookups should be answered stale and refresh the cache", func() {
+			atomic.StoreInt32(&failing, 0)
+			settings.Cache.ClientTimeout = 100
+			start := time.Now()
+			m := ask(1)
+			So(time.Since(start), ShouldBeLessThan, 350*time.Millisecond)
+			So(m.Answer[0].Header().Ttl, ShouldEqual, 30)
+			So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "127.0.0.1")
+
+			// the lookup carries on in the background
+			time.Sleep(500 * time.Millisecond)
+			m = ask(2)
+			So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "192.0.2.1")
+			So(m.Answer[0].Header().Ttl, ShouldBeBetweenOrEqual, 299, 300)
+			So(atomic.LoadInt64(&queries), ShouldEqual, 1)
+			So(h.Stats().Hits, ShouldEqual, 1)
+		})
+
+		Convey("Expired answers past the stale window should not be served", func() {
+			h.cache, _ = NewMemoryCache(0, 0, "", 0, 0)
+			h.cache.Set(key, newTestMsg("www.example.com", 300), -time.Second)
+			So(ask(1).Rcode, ShouldEqual, dns.RcodeServerFailure)
+			So(h.Stats().Stale, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestHandlerCacheRules(t *testing.T) {
+	Convey("The handler should apply the cache rules of a domain", t, func() {
+		var queries int64
+		var failing int32
+		answer := answerA(300, &queries)
+		upstream, addr := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			if atomic.LoadInt32(&failing) == 1 {
+				m := new(dns.Msg)
+				m.SetRcode(req, dns.RcodeServerFailure)
+				w.WriteMsg(m)
+				return
+			}
+			answer(w, req)
+		})
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+		h.cache, _ = NewMemoryCache(0, 0, "", 0, time.Hour)
+		noStale, stale := false, true
+		rules, err := NewCacheRules([]CacheRule{
+			{Domain: "lb.example.com", NoCache: true},
+			{Domain: "fresh.example.com", StaleAllowed: &noStale},
+			{Domain: "slow.example.com", StaleAllowed: &stale},
+		})
+		So(err, ShouldBeNil)
+		h.rules = rules
+
+		ask := func(qname string) *dns.Msg {
+			w := new(testResponseWriter)
+			req := new(dns.Msg)
+			req.SetQuestion(qname, dns.TypeA)
+			h.DoUDP(w, req)
+			return w.last()
+		}
+
+		Convey("no-cache names should be asked upstream every time", func() {
+			for i := 0; i < 3; i++ {
+				So(ask("health.lb.example.com.").Answer, ShouldHaveLength, 1)
+			}
+			So(atomic.LoadInt64(&queries), ShouldEqual, 3)
+			So(h.cache.Exists(KeyGen(Question{"health.lb.example.com", "A", "IN"}, "")), ShouldBeFalse)
+
+			ask("www.example.com.")
+			ask("www.example.com.")
+			So(atomic.LoadInt64(&queries), ShouldEqual, 4)
+		})
+
+		expire := func(qnames ...string) {
+			for _, qname := range qnames {
+				key := KeyGen(Question{qname, "A", "IN"}, "")
+				h.cache.Set(key, newTestMsg(qname, 300), -time.Second)
+			}
+			atomic.StoreInt32(&failing, 1)
+		}
+
+		Convey("stale-allowed = false names should never be served stale", func() {
+			defer func(cs CacheSettings) { settings.Cache = cs }(settings.Cache)
+			settings.Cache.ServeStale = true
+			expire("www.fresh.example.com", "www.example.com")
+
+			So(ask("www.fresh.example.com.").Rcode, ShouldEqual, dns.RcodeServerFailure)
+			So(ask("www.example.com.").Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(h.Stats().Stale, ShouldEqual, 1)
+		})
+
+		Convey("stale-allowed = true names should be served stale without serve-stale", func() {
+			So(settings.Cache.ServeStale, ShouldBeFalse)
+			expire("www.slow.example.com", "www.example.com")
+
+			So(ask("www.slow.example.com.").Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(ask("www.example.com.").Rcode, ShouldEqual, dns.RcodeServerFailure)
+			So(h.Stats().Stale, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestHandlerTruncation(t *testing.T) {
+	Convey("UDP responses should be truncated to the client buffer size", t, func() {
+		upstream, addr := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			for i := 0; i < 60; i++ {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+				rr.(*dns.A).A[3] = byte(i)
+				m.Answer = append(m.Answer, rr)
+			}
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+				m.Truncate(udpSize(req))
+			}
+			w.WriteMsg(m)
+		})
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+
+		req := new(dns.Msg)
+		req.SetQuestion("big.example.com.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		w := new(testResponseWriter)
+		h.DoUDP(w, req)
+		So(w.last().Truncated, ShouldEqual, false)
+		So(len(w.last().Answer), ShouldEqual, 60)
+
+		Convey("Clients without EDNS get 512 bytes at most", func() {
+			plain := new(dns.Msg)
+			plain.SetQuestion("big.example.com.", dns.TypeA)
+			h.DoUDP(w, plain)
+			m := w.last()
+			So(m.Truncated, ShouldEqual, true)
+			So(m.Len(), ShouldBeLessThanOrEqualTo, dns.MinMsgSize)
+			So(len(m.Answer), ShouldBeLessThan, 60)
+
+			Convey("TCP clients get the whole answer", func() {
+				h.DoTCP(&tcpTestResponseWriter{w}, plain)
+				So(w.last().Truncated, ShouldEqual, false)
+				So(len(w.last().Answer), ShouldEqual, 60)
+			})
+		})
+
+		Convey("Clients get what their OPT record asks for", func() {
+			small := new(dns.Msg)
+			small.SetQuestion("big.example.com.", dns.TypeA)
+			small.SetEdns0(700, false)
+			h.DoUDP(w, small)
+			m := w.last()
+			So(m.Truncated, ShouldEqual, true)
+			So(m.Len(), ShouldBeLessThanOrEqualTo, 700)
+			So(m.Len(), ShouldBeGreaterThan, dns.MinMsgSize)
+		})
+	})
+}
+
+// tcpTestResponseWriter is a testResponseWriter for TCP clients.
+type tcpTestResponseWriter struct {
+	*testResponseWriter
+}
+
+func (w *tcpTestResponseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func TestHandlerEDNS0(t *testing.T) {
+	Convey("The handler should act as an EDNS0 middlebox", t, func() {
+		var queries int64
+		answer := answerA(300, &queries)
+		seen := make(chan *dns.Msg, 4)
+		upstream, addr := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			seen <- req
+			answer(w, req)
+		})
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(65535, false)
+		w := new(testResponseWriter)
+		h.DoUDP(w, req)
+
+		up := <-seen
+		So(up.IsEdns0().UDPSize(), ShouldEqual, settings.ResolvConfig.EDNS0Size())
+		So(up.IsEdns0().Do(), ShouldEqual, false)
+		So(req.IsEdns0().UDPSize(), ShouldEqual, 65535)
+		So(w.last().IsEdns0(), ShouldNotBeNil)
+
+		Convey("Clients without EDNS0 get answers without OPT, even from cache", func() {
+			plain := new(dns.Msg)
+			plain.SetQuestion("www.example.com.", dns.TypeA)
+			h.DoUDP(w, plain)
+			So(w.last().IsEdns0(), ShouldBeNil)
+			So(len(w.last().Answer), ShouldEqual, 1)
+		})
+	})
+}
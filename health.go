@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamStatus is the health of a nameserver, as last probed.
+type UpstreamStatus struct {
+	Nameserver string        `json:"nameserver"`
+	Up         bool          `json:"up"`
+	Fails      int           `json:"consecutive_failures"`
+	LastCheck  time.Time     `json:"last_check"`
+	LastError  string        `json:"last_error,omitempty"`
+	RTT        time.Duration `json:"rtt"`
+}
+
+// HealthChecker probes nameservers in the background, and marks them down
+// after a number of consecutive failed probes, up again after a number of
+// consecutive successful ones. Nameservers start up.
+type HealthChecker struct {
+	config HealthCheckSettings
+	probe  func(nameserver string) (time.Duration, error)
+	quit   chan struct{}
+
+	mu     sync.RWMutex
+	status map[string]*upstreamHealth
+}
+
+type upstreamHealth struct {
+	UpstreamStatus
+	successes int
+}
+
+func NewHealthChecker(config HealthCheckSettings, nameservers []string, probe func(string) (time.Duration, error)) *HealthChecker {
+	hc := &HealthChecker{
+		config: config,
+		probe:  probe,
+		quit:   make(chan struct{}),
+		status: make(map[string]*upstreamHealth),
+	}
+	for _, ns := range nameservers {
+		hc.status[ns] = &upstreamHealth{UpstreamStatus: UpstreamStatus{Nameserver: ns, Up: true}}
+	}
+	return hc
+}
+
+// Run probes every nameserver each interval, until Stop.
+func (hc *HealthChecker) Run() {
+	ticker := time.NewTicker(hc.config.IntervalDuration())
+	defer ticker.Stop()
+	for {
+		hc.Check()
+		select {
+		case <-ticker.C:
+		case <-hc.quit:
+			return
+		}
+	}
+}
+
+func (hc *HealthChecker) Stop() {
+	close(hc.quit)
+}
+
+// Check probes every nameserver once, concurrently.
+func (hc *HealthChecker) Check() {
+	var wg sync.WaitGroup
+	for ns := range hc.status {
+		wg.Add(1)
+		go func(ns string) {
+			defer wg.Done()
+			rtt, err := hc.probe(ns)
+			hc.record(ns, rtt, err)
+		}(ns)
+	}
+	wg.Wait()
+}
+
+func (hc *HealthChecker) record(ns string, rtt time.Duration, err error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	s := hc.status[ns]
+	s.LastCheck = time.Now()
+	s.RTT = rtt
+	if err != nil {
+		s.LastError = err.Error()
+		s.Fails++
+		s.successes = 0
+		if s.Up && s.Fails >= hc.config.FailThreshold() {
+			s.Up = false
+			logger.Warn("%s is down after %d failed probes: %s", ns, s.Fails, err)
+		}
+		return
+	}
+	s.LastError = ""
+	s.Fails = 0
+	s.successes++
+	if !s.Up && s.successes >= hc.config.RecoverThreshold() {
+		s.Up = true
+		logger.Info("%s is up again", ns)
+	}
+}
+
+// Up tells whether ns is up. Nameservers it doesn't check are.
+func (hc *HealthChecker) Up(ns string) bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	s, ok := hc.status[ns]
+	return !ok || s.Up
+}
+
+// Status returns the status of the nameservers, sorted by name.
+func (hc *HealthChecker) Status() []UpstreamStatus {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	status := make([]UpstreamStatus, 0, len(hc.status))
+	for _, s := range hc.status {
+		status = append(status, s.UpstreamStatus)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Nameserver < status[j].Nameserver })
+	return status
+}
+
+// Probe is the question nameservers are probed with, the root NS records
+// by default.
+func (s HealthCheckSettings) Probe() (string, uint16) {
+	name, qtype := ".", dns.TypeNS
+	if s.ProbeName != "" {
+		name = dns.Fqdn(s.ProbeName)
+	}
+	if t, ok := dns.StringToType[strings.ToUpper(s.ProbeType)]; ok {
+		qtype = t
+	}
+	return name, qtype
+}
+
+// probeError is returned when a probe got an answer saying the nameserver
+// can't serve.
+type probeError struct {
+	rcode int
+}
+
+func (e probeError) Error() string {
+	return "probe answered " + dns.RcodeToString[e.rcode]
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealthChecker(t *testing.T) {
+	if logger == nil {
+		logger = NewLogger()
+	}
+
+	Convey("HealthChecker", t, func() {
+		var mu sync.Mutex
+		failing := map[string]bool{}
+		probe := func(ns string) (time.Duration, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failing[ns] {
+				return 0, errors.New("timeout")
+			}
+			return time.Millisecond, nil
+		}
+		setFailing := func(ns string, fail bool) {
+			mu.Lock()
+			failing[ns] = fail
+			mu.Unlock()
+		}
+		hc := NewHealthChecker(HealthCheckSettings{Fails: 2, Successes: 2}, []string{"a:53", "b:53"}, probe)
+
+		Convey("Should start with every nameserver up", func() {
+			So(hc.Up("a:53"), ShouldBeTrue)
+			So(hc.Up("b:53"), ShouldBeTrue)
+			So(hc.Up("unknown:53"), ShouldBeTrue)
+		})
+
+		Convey("Should mark nameservers down after consecutive failures", func() {
+			setFailing("a:53", true)
+			hc.Check()
+			So(hc.Up("a:53"), ShouldBeTrue)
+			hc.Check()
+			So(hc.Up("a:53"), ShouldBeFalse)
+			So(hc.Up("b:53"), ShouldBeTrue)
+
+			status := hc.Status()
+			So(status, ShouldHaveLength, 2)
+			So(status[0].Nameserver, ShouldEqual, "a:53")
+			So(status[0].Fails, ShouldEqual, 2)
+			So(status[0].LastError, ShouldEqual, "timeout")
+
+			Convey("And up again after consecutive successes", func() {
+				setFailing("a:53", false)
+				hc.Check()
+				So(hc.Up("a:53"), ShouldBeFalse)
+				hc.Check()
+				So(hc.Up("a:53"), ShouldBeTrue)
+				So(hc.Status()[0].LastError, ShouldEqual, "")
+			})
+
+			Convey("And only after consecutive ones", func() {
+				setFailing("a:53", false)
+				hc.Check()
+				setFailing("a:53", true)
+				hc.Check()
+				setFailing("a:53", false)
+				hc.Check()
+				So(hc.Up("a:53"), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestResolverHealthCheck(t *testing.T) {
+	if logger == nil {
+		logger = NewLogger()
+	}
+	var queries int64
+	_, good := newTestUpstream(t, answerA(60, &queries))
+	_, bad := newTestUpstream(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+
+	Convey("Resolver health checks", t, func() {
+		r := NewResolver(ResolvSettings{
+			Timeout:     1,
+			Servers:     []string{bad, good},
+			HealthCheck: HealthCheckSettings{Enable: true, Interval: 3600, Fails: 1},
+		})
+		defer r.health.Stop()
+		r.health.Check()
+
+		Convey("Should skip the nameservers down", func() {
+			So(r.Nameservers("www.example.com."), ShouldResemble, []string{good})
+		})
+
+		Convey("Should keep them all when they are all down", func() {
+			r.health.record(good, 0, errors.New("timeout"))
+			So(r.Nameservers("www.example.com."), ShouldResemble, []string{bad, good})
+		})
+
+		Convey("Should serve the status on the control interface", func() {
+			srv := httptest.NewServer(NewControlServer(&GODNSHandler{resolver: r}))
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + "/upstreams")
+			So(err, ShouldBeNil)
+			var status []UpstreamStatus
+			So(json.NewDecoder(resp.Body).Decode(&status), ShouldBeNil)
+			resp.Body.Close()
+			So(status, ShouldHaveLength, 2)
+			byName := map[string]UpstreamStatus{}
+			for _, s := range status {
+				byName[s.Nameserver] = s
+			}
+			So(byName[good].Up, ShouldBeTrue)
+			So(byName[bad].Up, ShouldBeFalse)
+			So(byName[bad].LastError, ShouldEqual, "probe answered SERVFAIL")
+		})
+	})
+}
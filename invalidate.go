@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoisie/redis"
+)
+
+// Invalidator spreads cache flushes over a redis pub/sub channel, so that
+// flushing a name on one godns instance drops it from the local memory of
+// every instance of the fleet, not only from the shared cache.
+type Invalidator struct {
+	client   *redis.Client
+	settings RedisSettings
+	channel  string
+	origin   string
+	flush    func(CacheFilter)
+}
+
+type invalidation struct {
+	Origin string      `json:"origin"`
+	Filter CacheFilter `json:"filter"`
+}
+
+// NewInvalidator returns an Invalidator calling flush for the flushes that
+// other instances publish on channel. Call Run to start listening.
+func NewInvalidator(rs RedisSettings, channel string, flush func(CacheFilter)) *Invalidator {
+	host, _ := os.Hostname()
+	return &Invalidator{
+		client:   &redis.Client{Addr: rs.Addr(), Db: rs.DB, Password: rs.Password},
+		settings: rs,
+		channel:  channel,
+		origin:   fmt.Sprintf("%s/%d/%d", host, os.Getpid(), time.Now().UnixNano()),
+		flush:    flush,
+	}
+}
+
+// Publish tells the other instances to flush the entries selected by filter.
+func (inv *Invalidator) Publish(filter CacheFilter) error {
+	msg, err := json.Marshal(invalidation{inv.origin, filter})
+	if err != nil {
+		return err
+	}
+	return inv.client.Publish(inv.channel, msg)
+}
+
+// Run listens to the channel, reconnecting whenever the subscription is
+// lost. It never returns.
+func (inv *Invalidator) Run() {
+	for {
+		err := inv.subscribe()
+		logger.Warn("Cache invalidation channel %s lost: %v", inv.channel, err)
+		time.Sleep(time.Second)
+	}
+}
+
+// subscribe listens to the channel over a connection of its own, until it
+// fails. The redis client can't end a subscription, so the connection is
+// kept out of it: closing it leaves nothing behind.
+func (inv *Invalidator) subscribe() error {
+	conn, err := net.DialTimeout("tcp", inv.settings.Addr(), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if inv.settings.Password != "" {
+		if err := writeRedisCommand(conn, "AUTH", inv.settings.Password); err != nil {
+			return err
+		}
+		if _, err := readRedisReply(r); err != nil {
+			return err
+		}
+	}
+	if err := writeRedisCommand(conn, "SUBSCRIBE", inv.channel); err != nil {
+		return err
+	}
+
+	logger.Info("Listen for cache invalidations on %s", inv.channel)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return err
+		}
+		if len(reply) == 3 && reply[0] == "message" {
+			inv.handle([]byte(reply[2]))
+		}
+	}
+}
+
+func (inv *Invalidator) handle(msg []byte) {
+	var inval invalidation
+	if err := json.Unmarshal(msg, &inval); err != nil {
+		logger.Warn("Invalid cache invalidation %q: %s", msg, err)
+		return
+	}
+	if inval.Origin == inv.origin {
+		return
+	}
+	logger.Debug("Cache invalidation %+v from %s", inval.Filter, inval.Origin)
+	inv.flush(inval.Filter)
+}
+
+// writeRedisCommand writes args as a RESP array of bulk strings.
+func writeRedisCommand(w io.Writer, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readRedisReply reads a reply, flattening an array into its elements.
+func readRedisReply(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return []string{line[1:]}, nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return []string{""}, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return []string{string(buf[:size])}, nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		var elems []string
+		for i := 0; i < n; i++ {
+			elem, err := readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem...)
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("invalid redis reply %q", line)
+}
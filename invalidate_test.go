@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInvalidator(t *testing.T) {
+	if logger == nil {
+		logger = NewLogger()
+	}
+
+	Convey("Flushing on one instance should flush the local tier of the others", t, func() {
+		srv := newFakeServer(t, serveFakeRedis)
+		defer srv.Close()
+		rs := RedisSettings{Host: "127.0.0.1", Port: srv.Port()}
+
+		newInstance := func() *GODNSHandler {
+			newTiered := func(prefix string) Cache {
+				l1, _ := NewMemoryCache(0, 0, "", 0, 0)
+				return NewTieredCache(l1, NewRedisCache(rs, prefix, 0))
+			}
+			failCache, _ := NewMemoryCache(0, 0, "", 0, 0)
+			h := &GODNSHandler{
+				cache:     newTiered("godns:cache:"),
+				negCache:  newTiered("godns:neg:"),
+				failCache: failCache,
+			}
+			h.invalidator = NewInvalidator(rs, "godns:invalidate", h.flushLocal)
+			go h.invalidator.subscribe()
+			return h
+		}
+		a, b := newInstance(), newInstance()
+
+		key := KeyGen(Question{"www.example.com", "A", "IN"}, "")
+		So(a.cache.Set(key, newTestMsg("www.example.com", 300), time.Minute), ShouldBeNil)
+		// b reads it through, into its local tier
+		_, err := b.cache.Get(key)
+		So(err, ShouldBeNil)
+		So(b.cache.(*TieredCache).L1.Exists(key), ShouldEqual, true)
+
+		// let both subscriptions settle
+		time.Sleep(100 * time.Millisecond)
+		So(a.Flush(CacheFilter{Name: "example.com", Suffix: true}), ShouldBeNil)
+
+		deadline := time.Now().Add(2 * time.Second)
+		for b.cache.(*TieredCache).L1.Exists(key) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(b.cache.(*TieredCache).L1.Exists(key), ShouldEqual, false)
+		So(b.cache.Exists(key), ShouldEqual, false)
+	})
+}
+
+func TestInvalidatorReconnect(t *testing.T) {
+	if logger == nil {
+		logger = NewLogger()
+	}
+
+	Convey("Lost subscriptions should leave no goroutine behind", t, func() {
+		// a redis that confirms the subscription, sends one invalidation and
+		// hangs up
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					args, err := readRedisCommand(bufio.NewReader(conn))
+					if err != nil || len(args) != 2 {
+						return
+					}
+					msg := `{"origin":"other","filter":{"name":"example.com"}}`
+					fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+					fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(msg), msg)
+				}()
+			}
+		}()
+
+		var flushes int64
+		flush := func(CacheFilter) { atomic.AddInt64(&flushes, 1) }
+		port := ln.Addr().(*net.TCPAddr).Port
+		up := NewInvalidator(RedisSettings{Host: "127.0.0.1", Port: port}, "godns:invalidate", flush)
+		// a port nothing listens on any more
+		dead, _ := net.Listen("tcp", "127.0.0.1:0")
+		dead.Close()
+		down := NewInvalidator(RedisSettings{Host: "127.0.0.1", Port: dead.Addr().(*net.TCPAddr).Port}, "godns:invalidate", flush)
+
+		So(up.subscribe(), ShouldNotBeNil)
+		So(down.subscribe(), ShouldNotBeNil)
+		time.Sleep(50 * time.Millisecond)
+		before := runtime.NumGoroutine()
+		for i := 0; i < 60; i++ {
+			So(up.subscribe(), ShouldNotBeNil)
+			So(down.subscribe(), ShouldNotBeNil)
+		}
+		So(atomic.LoadInt64(&flushes), ShouldEqual, 61)
+		// the fake redis winds its connections down on its own time
+		after := runtime.NumGoroutine()
+		for deadline := time.Now().Add(2 * time.Second); after > before && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			after = runtime.NumGoroutine()
+		}
+		So(after, ShouldBeLessThanOrEqualTo, before)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"syscall"
 	"time"
 )
 
@@ -23,6 +24,14 @@ func main() {
 		wTimeout: 5 * time.Second,
 	}
 
+	// Run may wait for the cache warmup: catch the signals already, so that
+	// they are handled once it returns rather than killing godns
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	server.Run()
 
 	logger.Info("godns %s start", settings.Version)
@@ -32,14 +41,15 @@ func main() {
 		go profileMEM()
 	}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
-
 forever:
 	for {
 		select {
+		case <-hup:
+			logger.Info("SIGHUP received, reloading")
+			server.Reload()
 		case <-sig:
 			logger.Info("signal received, stopping")
+			server.Stop()
 			break forever
 		}
 	}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Snapshot file layout: the magic header, then one section per cache.
+// A section is a list of (key length, key, entry length, entry) records,
+// entries being packEntry encoded, terminated by a zero key length.
+const snapshotMagic = "GODNSCACHE2\n"
+
+// PersistentCache is a cache which can be saved to and restored from a
+// snapshot section, so that a restart doesn't start from a cold cache.
+type PersistentCache interface {
+	Dump(w io.Writer) error
+	Load(r io.Reader) (int, error)
+}
+
+func writeSnapshotRecord(w io.Writer, key string, mesg Mesg) error {
+	entry, err := packEntry(mesg.Msg, mesg.Stored, mesg.Expire)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 6)
+	binary.BigEndian.PutUint16(hdr, uint16(len(key)))
+	binary.BigEndian.PutUint32(hdr[2:], uint32(len(entry)))
+	if _, err = w.Write(hdr[:2]); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, key); err != nil {
+		return err
+	}
+	if _, err = w.Write(hdr[2:]); err != nil {
+		return err
+	}
+	_, err = w.Write(entry)
+	return err
+}
+
+func writeSnapshotEnd(w io.Writer) error {
+	_, err := w.Write([]byte{0, 0})
+	return err
+}
+
+// readSnapshotSection hands every record of a section to restore, and
+// returns how many of them it kept.
+func readSnapshotSection(r io.Reader, restore func(key string, mesg Mesg) bool) (int, error) {
+	n := 0
+	hdr := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+			return n, err
+		}
+		keylen := binary.BigEndian.Uint16(hdr[:2])
+		if keylen == 0 {
+			return n, nil
+		}
+		key := make([]byte, keylen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return n, err
+		}
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return n, err
+		}
+		entry := make([]byte, binary.BigEndian.Uint32(hdr))
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return n, err
+		}
+
+		mesg, err := decodeEntry(entry)
+		if err != nil {
+			logger.Warn("Load cache entry %s failed: %s", key, err)
+			continue
+		}
+		if restore(string(key), mesg) {
+			n++
+		}
+	}
+}
+
+// dumpRecords writes the live entries of the cache. They are copied out
+// first, so that the cache isn't locked while they are written to disk; the
+// cache never modifies a stored message, which can be shared.
+func (c *MemoryCache) dumpRecords(w io.Writer) error {
+	type record struct {
+		key  string
+		mesg Mesg
+	}
+	now := time.Now()
+
+	c.mu.RLock()
+	records := make([]record, 0, len(c.Backend))
+	for key, mesg := range c.Backend {
+		if !mesg.Expire.Add(c.stale).Before(now) {
+			records = append(records, record{key, mesg})
+		}
+	}
+	c.mu.RUnlock()
+
+	for _, r := range records {
+		if err := writeSnapshotRecord(w, r.key, r.mesg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore puts back an entry read from a snapshot, unless it expired since.
+func (c *MemoryCache) restore(key string, mesg Mesg) bool {
+	if mesg.Expire.Add(c.stale).Before(time.Now()) {
+		return false
+	}
+	return c.put(key, mesg) == nil
+}
+
+// Dump writes every live entry of the cache as a snapshot section.
+func (c *MemoryCache) Dump(w io.Writer) error {
+	if err := c.dumpRecords(w); err != nil {
+		return err
+	}
+	return writeSnapshotEnd(w)
+}
+
+// Load reads a snapshot section into the cache, skipping the entries which
+// expired since, and returns how many were loaded.
+func (c *MemoryCache) Load(r io.Reader) (int, error) {
+	return readSnapshotSection(r, c.restore)
+}
+
+func (c *ShardedCache) Dump(w io.Writer) error {
+	for _, shard := range c.shards {
+		if err := shard.dumpRecords(w); err != nil {
+			return err
+		}
+	}
+	return writeSnapshotEnd(w)
+}
+
+func (c *ShardedCache) Load(r io.Reader) (int, error) {
+	return readSnapshotSection(r, func(key string, mesg Mesg) bool {
+		return c.shard(key).restore(key, mesg)
+	})
+}
+
+// persistentCaches returns the caches worth saving across restarts, in
+// snapshot order. The remote backends survive a restart on their own, and
+// failures are too short lived to bother.
+func (h *GODNSHandler) persistentCaches() []PersistentCache {
+	var caches []PersistentCache
+	for _, cache := range []Cache{h.cache, h.negCache} {
+		if pc, ok := cache.(PersistentCache); ok {
+			caches = append(caches, pc)
+		}
+	}
+	return caches
+}
+
+// SaveCache snapshots the memory caches into file. The snapshot is written
+// aside and renamed over file, so a crash never leaves a truncated one.
+func (h *GODNSHandler) SaveCache(file string) error {
+	caches := h.persistentCaches()
+	if len(caches) == 0 {
+		return nil
+	}
+
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	if _, err = io.WriteString(w, snapshotMagic); err == nil {
+		for _, cache := range caches {
+			if err = cache.Dump(w); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// LoadCache warms the memory caches up from a snapshot written by SaveCache.
+func (h *GODNSHandler) LoadCache(file string) (int, error) {
+	caches := h.persistentCaches()
+	if len(caches) == 0 {
+		return 0, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+		return 0, fmt.Errorf("%s is not a godns cache snapshot", file)
+	}
+
+	total := 0
+	for _, cache := range caches {
+		n, err := cache.Load(r)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (h *GODNSHandler) saveCachePeriodically(file string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if err := h.SaveCache(file); err != nil {
+			logger.Warn("Save cache snapshot %s failed: %s", file, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	Convey("A cache section should round trip, skipping expired entries", t, func() {
+		cache, _ := NewMemoryCache(0, 0, "", 0, 0)
+		cache.Set("a", newTestMsg("a.example.com", 300), time.Minute)
+		cache.Set("b", newTestMsg("b.example.com", 300), -time.Second)
+
+		var buf bytes.Buffer
+		So(cache.Dump(&buf), ShouldBeNil)
+
+		sharded, _ := NewShardedCache(4, 0, 0, "", 0, 0)
+		n, err := sharded.Load(&buf)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		m, err := sharded.Get("a")
+		So(err, ShouldBeNil)
+		So(m.Answer[0].Header().Ttl, ShouldEqual, 300)
+		So(sharded.Exists("b"), ShouldEqual, false)
+	})
+
+	Convey("The handler should save and load its caches", t, func() {
+		dir, _ := os.MkdirTemp("", "godns")
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "cache")
+
+		cache, _ := NewMemoryCache(0, 0, "", 0, 0)
+		negCache, _ := NewMemoryCache(0, 0, "", 0, 0)
+		cache.Set("a", newTestMsg("a.example.com", 300), time.Minute)
+		negCache.Set("nx", newTestMsg("nx.example.com"), time.Minute)
+		h := &GODNSHandler{cache: cache, negCache: negCache}
+		So(h.SaveCache(file), ShouldBeNil)
+
+		cache, _ = NewMemoryCache(0, 0, "", 0, 0)
+		negCache, _ = NewMemoryCache(0, 0, "", 0, 0)
+		h = &GODNSHandler{cache: cache, negCache: negCache}
+		n, err := h.LoadCache(file)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(cache.Exists("a"), ShouldEqual, true)
+		So(negCache.Exists("nx"), ShouldEqual, true)
+		So(cache.Exists("nx"), ShouldEqual, false)
+	})
+}
+
+// blockingWriter blocks writes until released.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return len(p), nil
+}
+
+func TestCacheSnapshotUnlocked(t *testing.T) {
+	Convey("A snapshot being written should not block the cache", t, func() {
+		cache, _ := NewMemoryCache(10, 0, "lru", 0, 0)
+		cache.Set("a", newTestMsg("a.example.com", 300), time.Minute)
+
+		w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+		dumped := make(chan error, 1)
+		go func() { dumped <- cache.Dump(w) }()
+		<-w.started
+
+		done := make(chan struct{})
+		go func() {
+			cache.Set("b", newTestMsg("b.example.com", 300), time.Minute)
+			cache.Get("a")
+			close(done)
+		}()
+		blocked := false
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			blocked = true
+		}
+		close(w.release)
+		So(<-dumped, ShouldBeNil)
+		So(blocked, ShouldBeFalse)
+		So(cache.Exists("b"), ShouldEqual, true)
+	})
+}
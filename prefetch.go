@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type prefetchEntry struct {
+	hits       uint64
+	lifetime   time.Duration
+	expire     time.Time
+	refreshing bool
+}
+
+// Prefetcher counts cache hits per key, so that popular entries can be
+// refreshed before they expire and clients never see the miss latency.
+type Prefetcher struct {
+	hits    uint64
+	percent int
+	entries map[string]*prefetchEntry
+	mu      sync.Mutex
+}
+
+// NewPrefetcher returns a Prefetcher that asks for a refresh once an entry
+// got at least hits hits and has less than percent of its TTL left.
+func NewPrefetcher(hits uint64, percent int) *Prefetcher {
+	p := &Prefetcher{
+		hits:    hits,
+		percent: percent,
+		entries: make(map[string]*prefetchEntry),
+	}
+	go p.sweeper(time.Minute)
+	return p
+}
+
+// Stored records that key was cached for lifetime, and resets its hits.
+func (p *Prefetcher) Stored(key string, lifetime time.Duration) {
+	p.mu.Lock()
+	p.entries[key] = &prefetchEntry{
+		lifetime: lifetime,
+		expire:   time.Now().Add(lifetime),
+	}
+	p.mu.Unlock()
+}
+
+// Hit records a cache hit on key. It returns true if key should be
+// refreshed now, in which case the caller must call Done once finished.
+func (p *Prefetcher) Hit(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[key]
+	if !ok {
+		return false
+	}
+	e.hits++
+	if e.refreshing || e.hits < p.hits {
+		return false
+	}
+
+	left := time.Until(e.expire)
+	if left <= 0 || left > e.lifetime*time.Duration(p.percent)/100 {
+		return false
+	}
+	e.refreshing = true
+	return true
+}
+
+// Done marks the refresh of key as finished, whether it succeeded or not.
+func (p *Prefetcher) Done(key string) {
+	p.mu.Lock()
+	if e, ok := p.entries[key]; ok {
+		e.refreshing = false
+	}
+	p.mu.Unlock()
+}
+
+// Sweep forgets the entries that expired.
+func (p *Prefetcher) Sweep() {
+	now := time.Now()
+	p.mu.Lock()
+	for key, e := range p.entries {
+		if e.expire.Before(now) && !e.refreshing {
+			delete(p.entries, key)
+		}
+	}
+	p.mu.Unlock()
+}
+
+func (p *Prefetcher) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		p.Sweep()
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrefetcher(t *testing.T) {
+	Convey("Popular entries should be refreshed near their expiry", t, func() {
+		p := NewPrefetcher(3, 50)
+
+		Convey("Unknown keys are never refreshed", func() {
+			So(p.Hit("unknown"), ShouldEqual, false)
+		})
+
+		Convey("Entries need enough hits", func() {
+			p.Stored("a", 100*time.Millisecond)
+			time.Sleep(60 * time.Millisecond)
+			So(p.Hit("a"), ShouldEqual, false)
+			So(p.Hit("a"), ShouldEqual, false)
+			So(p.Hit("a"), ShouldEqual, true)
+
+			Convey("and only one refresh runs at a time", func() {
+				So(p.Hit("a"), ShouldEqual, false)
+				p.Done("a")
+				So(p.Hit("a"), ShouldEqual, true)
+			})
+		})
+
+		Convey("Entries with most of their TTL left are not refreshed", func() {
+			p.Stored("b", time.Hour)
+			for i := 0; i < 10; i++ {
+				So(p.Hit("b"), ShouldEqual, false)
+			}
+		})
+	})
+}
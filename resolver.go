@@ -23,6 +23,17 @@ func (e ResolvError) Error() string {
 	return errmsg
 }
 
+// ResolvTimeout is returned when the upstreams didn't answer before the
+// client had to be answered.
+type ResolvTimeout struct {
+	qname   string
+	timeout time.Duration
+}
+
+func (e ResolvTimeout) Error() string {
+	return fmt.Sprintf("%s not resolved within %v", e.qname, e.timeout)
+}
+
 type RResp struct {
 	msg        *dns.Msg
 	nameserver string
@@ -33,6 +44,11 @@ type Resolver struct {
 	servers       []string
 	domain_server *suffixTreeNode
 	config        *ResolvSettings
+	// upstreams of the nameserver URLs, by URL
+	upstreams map[string]Upstream
+	// the nameservers of domain_server, as Nameservers returns them
+	domainServers map[string]bool
+	health        *HealthChecker
 }
 
 func NewResolver(c ResolvSettings) *Resolver {
@@ -40,6 +56,20 @@ func NewResolver(c ResolvSettings) *Resolver {
 		servers:       []string{},
 		domain_server: newSuffixTreeRoot(),
 		config:        &c,
+		upstreams:     make(map[string]Upstream),
+		domainServers: make(map[string]bool),
+	}
+
+	for _, server := range c.Servers {
+		if isUpstreamURL(server) {
+			r.addUpstream(server)
+			r.servers = append(r.servers, server)
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.servers = append(r.servers, server)
 	}
 
 	if len(c.ServerListFile) > 0 {
@@ -59,9 +89,47 @@ func NewResolver(c ResolvSettings) *Resolver {
 		}
 	}
 
+	if c.HealthCheck.Enable {
+		r.health = NewHealthChecker(c.HealthCheck, r.nameservers(), r.probe)
+		go r.health.Run()
+	}
+
 	return r
 }
 
+// nameservers returns every nameserver of the resolver, once.
+func (r *Resolver) nameservers() []string {
+	seen := make(map[string]bool)
+	var ns []string
+	for _, server := range r.servers {
+		if !seen[server] {
+			seen[server] = true
+			ns = append(ns, server)
+		}
+	}
+	for server := range r.domainServers {
+		if !seen[server] {
+			seen[server] = true
+			ns = append(ns, server)
+		}
+	}
+	return ns
+}
+
+// addUpstream sets up the Upstream of a nameserver URL. An invalid one
+// panics rather than have its domains resolved in clear text.
+func (r *Resolver) addUpstream(s string) {
+	if _, ok := r.upstreams[s]; ok {
+		return
+	}
+	u, err := NewUpstream(s, r.Timeout())
+	if err != nil {
+		logger.Error("%s is not a valid nameserver: %s", s, err)
+		panic(err)
+	}
+	r.upstreams[s] = u
+}
+
 func (r *Resolver) parseServerListFile(buf *os.File) {
 	scanner := bufio.NewScanner(buf)
 	for scanner.Scan() {
@@ -72,23 +140,40 @@ func (r *Resolver) parseServerListFile(buf *os.File) {
 			continue
 		}
 
-		sli := strings.Split(line, "=")
+		sli := strings.SplitN(line, "=", 2)
 		if len(sli) != 2 {
 			continue
 		}
 
 		line = strings.TrimSpace(sli[1])
 
+		// nameserver URLs have slashes of their own
+		if isUpstreamURL(line) && !strings.HasPrefix(line, "/") {
+			r.addUpstream(line)
+			r.servers = append(r.servers, line)
+			continue
+		}
+
 		tokens := strings.Split(line, "/")
+		if strings.HasPrefix(line, "/") {
+			tokens = strings.SplitN(line, "/", 3)
+		}
 		switch len(tokens) {
 		case 3:
 			domain := tokens[1]
 			ip := tokens[2]
 
+			if isUpstreamURL(ip) && isDomain(domain) {
+				r.addUpstream(ip)
+				r.domain_server.sinsert(strings.Split(domain, "."), ip)
+				r.domainServers[ip] = true
+				continue
+			}
 			if !isDomain(domain) || !isIP(ip) {
 				continue
 			}
 			r.domain_server.sinsert(strings.Split(domain, "."), ip)
+			r.domainServers[net.JoinHostPort(ip, "53")] = true
 		case 1:
 			srv_port := strings.Split(line, "#")
 			if len(srv_port) > 2 {
@@ -135,17 +220,35 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error
 		WriteTimeout: r.Timeout(),
 	}
 
-	if net == "udp" && settings.ResolvConfig.SetEDNS0 {
-		req = req.SetEdns0(65535, true)
+	tcp := &dns.Client{
+		Net:          "tcp",
+		ReadTimeout:  r.Timeout(),
+		WriteTimeout: r.Timeout(),
 	}
 
+	req = upstreamQuery(req, settings.ResolvConfig.EDNS0Size(), settings.ResolvConfig.SetEDNS0)
+
 	qname := req.Question[0].Name
 
+	upstreams := r.upstreams
 	res := make(chan *RResp, 1)
 	var wg sync.WaitGroup
 	L := func(nameserver string) {
 		defer wg.Done()
-		r, rtt, err := c.Exchange(req, nameserver)
+		var r *dns.Msg
+		var rtt time.Duration
+		var err error
+		u, encrypted := upstreams[nameserver]
+		if encrypted {
+			r, rtt, err = u.Exchange(req)
+		} else {
+			r, rtt, err = c.Exchange(req, nameserver)
+		}
+		if err == nil && r.Truncated && c.Net == "udp" && !encrypted {
+			// the answer didn't fit our buffer, ask again over TCP
+			logger.Debug("%s truncated on %s, retry over TCP", qname, nameserver)
+			r, rtt, err = tcp.Exchange(req, nameserver)
+		}
 		if err != nil {
 			logger.Warn("%s socket error on %s", qname, nameserver)
 			logger.Warn("error:%s", err.Error())
@@ -197,6 +300,7 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error
 
 // Namservers return the array of nameservers, with port number appended.
 // '#' in the name is treated as port separator, as with dnsmasq.
+// Nameserver URLs are returned as they are.
 
 func (r *Resolver) Nameservers(qname string) []string {
 	queryKeys := strings.Split(qname, ".")
@@ -206,16 +310,69 @@ func (r *Resolver) Nameservers(qname string) []string {
 	if v, found := r.domain_server.search(queryKeys); found {
 		logger.Debug("%s be found in domain server list, upstream: %v", qname, v)
 		server := v
-		nameserver := net.JoinHostPort(server, "53")
+		nameserver := server
+		if !isUpstreamURL(server) {
+			nameserver = net.JoinHostPort(server, "53")
+		}
 		ns = append(ns, nameserver)
 		//Ensure query the specific upstream nameserver in async Lookup() function.
-		return ns
+		return r.healthy(ns)
 	}
 
 	for _, nameserver := range r.servers {
 		ns = append(ns, nameserver)
 	}
-	return ns
+	return r.healthy(ns)
+}
+
+// healthy leaves the nameservers down out of ns, unless they all are: they
+// may still answer better than nothing.
+func (r *Resolver) healthy(ns []string) []string {
+	if r.health == nil {
+		return ns
+	}
+	up := make([]string, 0, len(ns))
+	for _, nameserver := range ns {
+		if r.health.Up(nameserver) {
+			up = append(up, nameserver)
+		}
+	}
+	if len(up) == 0 {
+		return ns
+	}
+	return up
+}
+
+// probe asks nameserver the health check question.
+func (r *Resolver) probe(nameserver string) (time.Duration, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(r.config.HealthCheck.Probe())
+
+	var resp *dns.Msg
+	var rtt time.Duration
+	var err error
+	if u, ok := r.upstreams[nameserver]; ok {
+		resp, rtt, err = u.Exchange(req)
+	} else {
+		c := &dns.Client{Net: "udp", ReadTimeout: r.Timeout(), WriteTimeout: r.Timeout()}
+		resp, rtt, err = c.Exchange(req, nameserver)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return rtt, probeError{resp.Rcode}
+	}
+	return rtt, nil
+}
+
+// UpstreamStatus returns the health of the nameservers, none without health
+// checks.
+func (r *Resolver) UpstreamStatus() []UpstreamStatus {
+	if r.health == nil {
+		return nil
+	}
+	return r.health.Status()
 }
 
 func (r *Resolver) Timeout() time.Duration {
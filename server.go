@@ -2,6 +2,7 @@ package main
 
 import (
 	"net"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -13,6 +14,8 @@ type Server struct {
 	port     int
 	rTimeout time.Duration
 	wTimeout time.Duration
+	handler  *GODNSHandler
+	certs    []*CertReloader
 }
 
 func (s *Server) Addr() string {
@@ -21,6 +24,7 @@ func (s *Server) Addr() string {
 
 func (s *Server) Run() {
 	Handler := NewHandler()
+	s.handler = Handler
 
 	tcpHandler := dns.NewServeMux()
 	tcpHandler.HandleFunc(".", Handler.DoTCP)
@@ -41,17 +45,107 @@ func (s *Server) Run() {
 		ReadTimeout:  s.rTimeout,
 		WriteTimeout: s.wTimeout}
 
+	if file := settings.Cache.WarmupFile; file != "" {
+		if settings.Cache.WarmupWait {
+			Handler.WarmupFromFile(file, settings.Cache.WarmupConcurrency)
+		} else {
+			go Handler.WarmupFromFile(file, settings.Cache.WarmupConcurrency)
+		}
+	}
+
 	go s.start(udpServer)
 	go s.start(tcpServer)
 
+	if tc := settings.Server.TLS; tc.Port > 0 {
+		certs := s.loadCerts(tc.CertFile, tc.KeyFile)
+
+		tlsServer := &dns.Server{Addr: net.JoinHostPort(s.host, strconv.Itoa(tc.Port)),
+			Net:          "tcp-tls",
+			TLSConfig:    certs.TLSConfig(),
+			Handler:      tcpHandler,
+			ReadTimeout:  s.rTimeout,
+			WriteTimeout: s.wTimeout}
+		go s.start(tlsServer)
+	}
+
+	if hc := settings.Server.HTTPS; hc.Port > 0 {
+		doh, err := NewDoHServer(Handler, hc)
+		if err != nil {
+			logger.Error("%s", err)
+			panic(err)
+		}
+		httpServer := &http.Server{Addr: net.JoinHostPort(s.host, strconv.Itoa(hc.Port)),
+			Handler:      doh,
+			ReadTimeout:  s.rTimeout,
+			WriteTimeout: s.wTimeout}
+		if hc.CertFile != "" {
+			httpServer.TLSConfig = s.loadCerts(hc.CertFile, hc.KeyFile).TLSConfig()
+		}
+		go s.startHTTP(httpServer)
+	}
+
+	if settings.Control.Port > 0 {
+		go NewControlServer(Handler).ListenAndServe(settings.Control.Addr())
+	}
+
+}
+
+// loadCerts loads the certificate of a TLS listener, to be reloaded along
+// with the others.
+func (s *Server) loadCerts(certFile, keyFile string) *CertReloader {
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		logger.Error("Load TLS certificate %s failed: %s", certFile, err)
+		panic(err)
+	}
+	s.certs = append(s.certs, certs)
+	return certs
+}
+
+// Reload loads the TLS certificates again.
+func (s *Server) Reload() {
+	for _, certs := range s.certs {
+		if err := certs.Reload(); err != nil {
+			logger.Error("Reload TLS certificate %s failed, keeping the previous one: %s", certs.certFile, err)
+			continue
+		}
+		logger.Info("Reload TLS certificate %s", certs.certFile)
+	}
+}
+
+// Stop saves the cache snapshot, if persistence is enabled.
+func (s *Server) Stop() {
+	file := settings.Cache.PersistFile
+	if s.handler == nil || file == "" {
+		return
+	}
+	if err := s.handler.SaveCache(file); err != nil {
+		logger.Error("Save cache snapshot %s failed: %s", file, err)
+		return
+	}
+	logger.Info("Save cache snapshot to %s", file)
 }
 
 func (s *Server) start(ds *dns.Server) {
 
-	logger.Info("Start %s listener on %s", ds.Net, s.Addr())
+	logger.Info("Start %s listener on %s", ds.Net, ds.Addr)
 	err := ds.ListenAndServe()
 	if err != nil {
-		logger.Error("Start %s listener on %s failed:%s", ds.Net, s.Addr(), err.Error())
+		logger.Error("Start %s listener on %s failed:%s", ds.Net, ds.Addr, err.Error())
 	}
 
 }
+
+func (s *Server) startHTTP(hs *http.Server) {
+	var err error
+	if hs.TLSConfig != nil {
+		logger.Info("Start https listener on %s", hs.Addr)
+		err = hs.ListenAndServeTLS("", "")
+	} else {
+		logger.Info("Start http listener on %s", hs.Addr)
+		err = hs.ListenAndServe()
+	}
+	if err != nil {
+		logger.Error("Start http listener on %s failed:%s", hs.Addr, err.Error())
+	}
+}
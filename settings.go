@@ -3,8 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -31,19 +33,87 @@ type Settings struct {
 	Log          LogSettings       `toml:"log"`
 	Cache        CacheSettings     `toml:"cache"`
 	Hosts        HostsSettings     `toml:"hosts"`
+	Control      ControlSettings   `toml:"control"`
 }
 
 type ResolvSettings struct {
-	Timeout        int
-	Interval       int
-	SetEDNS0       bool
-	ServerListFile string `toml:"server-list-file"`
-	ResolvFile     string `toml:"resolv-file"`
+	Timeout         int
+	Interval        int
+	SetEDNS0        bool
+	EDNS0BufferSize uint16 `toml:"edns0-buffer-size"`
+	ServerListFile  string `toml:"server-list-file"`
+	ResolvFile      string `toml:"resolv-file"`
+	// Servers are nameservers asked before those of ResolvFile, as
+	// addresses or nameserver URLs (see NewUpstream).
+	Servers     []string
+	HealthCheck HealthCheckSettings `toml:"health-check"`
+}
+
+// HealthCheckSettings configure the background probing of the nameservers,
+// see HealthChecker.
+type HealthCheckSettings struct {
+	Enable    bool
+	Interval  int    // seconds
+	ProbeName string `toml:"probe-name"`
+	ProbeType string `toml:"probe-type"`
+	Fails     int    `toml:"fail-threshold"`
+	Successes int    `toml:"recover-threshold"`
+}
+
+func (s HealthCheckSettings) IntervalDuration() time.Duration {
+	if s.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(s.Interval) * time.Second
+}
+
+func (s HealthCheckSettings) FailThreshold() int {
+	if s.Fails <= 0 {
+		return 3
+	}
+	return s.Fails
+}
+
+func (s HealthCheckSettings) RecoverThreshold() int {
+	if s.Successes <= 0 {
+		return 2
+	}
+	return s.Successes
+}
+
+// EDNS0Size is the UDP buffer size advertised to upstreams and clients.
+func (rs ResolvSettings) EDNS0Size() uint16 {
+	if rs.EDNS0BufferSize == 0 {
+		return defaultEDNS0Size
+	}
+	return rs.EDNS0BufferSize
 }
 
 type DNSServerSettings struct {
-	Host string
-	Port int
+	Host  string
+	Port  int
+	TLS   ServerTLSSettings   `toml:"tls"`
+	HTTPS ServerHTTPSSettings `toml:"https"`
+}
+
+// ServerTLSSettings configure the DNS over TLS listener, on the server host.
+type ServerTLSSettings struct {
+	Port     int
+	CertFile string `toml:"cert-file"`
+	KeyFile  string `toml:"key-file"`
+}
+
+// ServerHTTPSSettings configure the DNS over HTTPS listener, on the server
+// host. Without a certificate, it serves plain HTTP for a reverse proxy.
+type ServerHTTPSSettings struct {
+	Port     int
+	CertFile string `toml:"cert-file"`
+	KeyFile  string `toml:"key-file"`
+	Path     string
+	JSON     bool `toml:"json"`
+	// TrustedProxies are the addresses or networks whose X-Forwarded-For
+	// headers are believed.
+	TrustedProxies []string `toml:"trusted-proxies"`
 }
 
 type RedisSettings struct {
@@ -79,6 +149,137 @@ type CacheSettings struct {
 	Backend  string
 	Expire   int
 	Maxcount int
+	Eviction string
+	Shards   int
+
+	MaxMemory int `toml:"max-memory"`
+
+	L1Maxcount int    `toml:"l1-maxcount"`
+	L2Backend  string `toml:"l2-backend"`
+	MinTTL     uint32 `toml:"min-ttl"`
+	MaxTTL     uint32 `toml:"max-ttl"`
+
+	MaxNegTTL   uint32 `toml:"max-neg-ttl"`
+	ServfailTTL uint32 `toml:"servfail-ttl"`
+
+	SweepInterval int `toml:"sweep-interval"`
+
+	ServeStale     bool   `toml:"serve-stale"`
+	StaleWindow    int    `toml:"stale-window"`
+	StaleAnswerTTL uint32 `toml:"stale-answer-ttl"`
+	ClientTimeout  int    `toml:"client-timeout"`
+
+	Prefetch        bool
+	PrefetchHits    uint64 `toml:"prefetch-hits"`
+	PrefetchPercent int    `toml:"prefetch-percent"`
+
+	PersistFile     string `toml:"persist-file"`
+	PersistInterval int    `toml:"persist-interval"`
+
+	InvalidationChannel string `toml:"invalidation-channel"`
+
+	WarmupFile        string `toml:"warmup-file"`
+	WarmupConcurrency int    `toml:"warmup-concurrency"`
+	WarmupWait        bool   `toml:"warmup-wait"`
+
+	Rules []CacheRule `toml:"rules"`
+}
+
+// CacheRule overrides the cache policy of a domain and its subdomains.
+// Zero TTLs fall back to the global min-ttl and max-ttl, an unset
+// stale-allowed to serve-stale. stale-allowed = true serves the domain stale
+// even with serve-stale disabled.
+type CacheRule struct {
+	Domain       string
+	NoCache      bool   `toml:"no-cache"`
+	MinTTL       uint32 `toml:"min-ttl"`
+	MaxTTL       uint32 `toml:"max-ttl"`
+	StaleAllowed *bool  `toml:"stale-allowed"`
+}
+
+// ExpireDuration is the cache lifetime of responses that carry no TTL.
+func (cs CacheSettings) ExpireDuration() time.Duration {
+	return time.Duration(cs.Expire) * time.Second
+}
+
+// StaleWindowDuration is how long expired answers are kept around to be
+// served stale. It is zero unless serve-stale is enabled, or a rule allows
+// stale answers for its domain.
+func (cs CacheSettings) StaleWindowDuration() time.Duration {
+	if !cs.ServeStale && !cs.staleAllowedByRule() {
+		return 0
+	}
+	return time.Duration(cs.StaleWindow) * time.Second
+}
+
+func (cs CacheSettings) staleAllowedByRule() bool {
+	for _, rule := range cs.Rules {
+		if rule.StaleAllowed != nil && *rule.StaleAllowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientTimeoutDuration is how long a client with a stale answer available
+// waits for the upstreams before being answered stale.
+func (cs CacheSettings) ClientTimeoutDuration() time.Duration {
+	return time.Duration(cs.ClientTimeout) * time.Millisecond
+}
+
+// PersistIntervalDuration is how often the cache snapshot is saved, on top
+// of at shutdown. Zero only saves it at shutdown.
+func (cs CacheSettings) PersistIntervalDuration() time.Duration {
+	return time.Duration(cs.PersistInterval) * time.Second
+}
+
+// MaxMemoryBytes is the memory budget of each memory cache. Zero means
+// unbounded.
+func (cs CacheSettings) MaxMemoryBytes() int64 {
+	return int64(cs.MaxMemory) << 20
+}
+
+// SweepIntervalDuration is how often expired entries are dropped from the
+// memory cache.
+func (cs CacheSettings) SweepIntervalDuration() time.Duration {
+	return time.Duration(cs.SweepInterval) * time.Second
+}
+
+// ClampTTL bounds ttl by min-ttl and max-ttl. A zero max-ttl means unbounded.
+func (cs CacheSettings) ClampTTL(ttl uint32) time.Duration {
+	if ttl < cs.MinTTL {
+		ttl = cs.MinTTL
+	}
+	if cs.MaxTTL > 0 && ttl > cs.MaxTTL {
+		ttl = cs.MaxTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// ClampNegTTL bounds the lifetime of a NXDOMAIN or NODATA response by
+// max-neg-ttl. A zero max-neg-ttl means unbounded.
+func (cs CacheSettings) ClampNegTTL(ttl uint32) time.Duration {
+	if cs.MaxNegTTL > 0 && ttl > cs.MaxNegTTL {
+		ttl = cs.MaxNegTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// ServfailTTLDuration is how long an upstream failure is answered with
+// SERVFAIL without asking again. Zero disables the failure cache.
+func (cs CacheSettings) ServfailTTLDuration() time.Duration {
+	return time.Duration(cs.ServfailTTL) * time.Second
+}
+
+// ControlSettings is the address of the HTTP control interface. It is
+// disabled unless port is set.
+type ControlSettings struct {
+	Host string
+	Port int
+}
+
+func (s ControlSettings) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
 }
 
 type HostsSettings struct {
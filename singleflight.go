@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+type lookupCall struct {
+	wg   sync.WaitGroup
+	mesg *dns.Msg
+	err  error
+	dups int
+}
+
+// LookupGroup coalesces concurrent lookups of the same question, so that
+// only one upstream exchange is in flight per key.
+type LookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+func NewLookupGroup() *LookupGroup {
+	return &LookupGroup{calls: make(map[string]*lookupCall)}
+}
+
+// Do runs fn for key, unless a call for key is already in flight, in which
+// case it waits for that call and returns its result. shared is true if
+// the result was handed to more than one caller; those must not modify it.
+func (g *LookupGroup) Do(key string, fn func() (*dns.Msg, error)) (mesg *dns.Msg, err error, shared bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.mesg, c.err, true
+	}
+	c := new(lookupCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.mesg, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	dups := c.dups
+	g.mu.Unlock()
+
+	return c.mesg, c.err, dups > 0
+}
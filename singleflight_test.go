@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLookupGroup(t *testing.T) {
+	Convey("Concurrent lookups of the same key should be coalesced", t, func() {
+		g := NewLookupGroup()
+		var calls int32
+		var shares int32
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m, err, shared := g.Do("key", func() (*dns.Msg, error) {
+					atomic.AddInt32(&calls, 1)
+					time.Sleep(100 * time.Millisecond)
+					return newTestMsg("www.example.com", 300), nil
+				})
+				if err == nil && m != nil && shared {
+					atomic.AddInt32(&shares, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		So(calls, ShouldEqual, 1)
+		So(shares, ShouldEqual, 50)
+
+		Convey("Later lookups should run again", func() {
+			_, _, shared := g.Do("key", func() (*dns.Msg, error) {
+				return nil, nil
+			})
+			So(shared, ShouldEqual, false)
+		})
+	})
+}
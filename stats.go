@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// handlerStats counts how queries were answered. Every query that isn't
+// answered from the hosts file counts once as a hit, a negative hit, a
+// failure hit or a miss. Stale counts those of them answered stale.
+type handlerStats struct {
+	queries    uint64
+	hits       uint64
+	negHits    uint64
+	failHits   uint64
+	misses     uint64
+	stale      uint64
+	prefetches uint64
+}
+
+// Stats is a snapshot of the counters of a handler and its caches.
+type Stats struct {
+	Queries    uint64 `json:"queries"`
+	Hits       uint64 `json:"hits"`
+	NegHits    uint64 `json:"neg_hits"`
+	FailHits   uint64 `json:"fail_hits"`
+	Misses     uint64 `json:"misses"`
+	Stale      uint64 `json:"stale"`
+	Prefetches uint64 `json:"prefetches"`
+
+	Caches map[string]CacheStats `json:"caches"`
+}
+
+func (h *GODNSHandler) Stats() Stats {
+	s := &h.stats
+	return Stats{
+		Queries:    atomic.LoadUint64(&s.queries),
+		Hits:       atomic.LoadUint64(&s.hits),
+		NegHits:    atomic.LoadUint64(&s.negHits),
+		FailHits:   atomic.LoadUint64(&s.failHits),
+		Misses:     atomic.LoadUint64(&s.misses),
+		Stale:      atomic.LoadUint64(&s.stale),
+		Prefetches: atomic.LoadUint64(&s.prefetches),
+		Caches: map[string]CacheStats{
+			"answer":   h.cache.Stats(),
+			"negative": h.negCache.Stats(),
+			"failure":  h.failCache.Stats(),
+		},
+	}
+}
+
+// WritePrometheus writes s in the Prometheus text exposition format.
+func (s Stats) WritePrometheus(w io.Writer) {
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(w, "# HELP godns_%s %s\n# TYPE godns_%s counter\ngodns_%s %d\n", name, help, name, name, v)
+	}
+	counter("queries_total", "Queries handled, hosts file answers aside.", s.Queries)
+	counter("cache_hits_total", "Queries answered from the answer cache.", s.Hits)
+	counter("cache_neg_hits_total", "Queries answered from the negative cache.", s.NegHits)
+	counter("cache_fail_hits_total", "Queries answered from the failure cache.", s.FailHits)
+	counter("cache_misses_total", "Queries sent upstream.", s.Misses)
+	counter("stale_answers_total", "Queries answered with an expired answer.", s.Stale)
+	counter("prefetches_total", "Answers refreshed before they expired.", s.Prefetches)
+
+	// Go maps have no order, keep the output stable
+	caches := []string{"answer", "negative", "failure"}
+	metric := func(name, kind, help string, value func(CacheStats) string) {
+		fmt.Fprintf(w, "# HELP godns_cache_%s %s\n# TYPE godns_cache_%s %s\n", name, help, name, kind)
+		for _, cache := range caches {
+			fmt.Fprintf(w, "godns_cache_%s{cache=%q} %s\n", name, cache, value(s.Caches[cache]))
+		}
+	}
+	metric("lookups_hit_total", "counter", "Cache lookups that found a fresh entry.",
+		func(c CacheStats) string { return fmt.Sprint(c.Hits) })
+	metric("lookups_miss_total", "counter", "Cache lookups that found no fresh entry.",
+		func(c CacheStats) string { return fmt.Sprint(c.Misses) })
+	metric("expired_total", "counter", "Entries dropped because they expired.",
+		func(c CacheStats) string { return fmt.Sprint(c.Expired) })
+	metric("evicted_total", "counter", "Entries evicted to make room for new ones.",
+		func(c CacheStats) string { return fmt.Sprint(c.Evicted) })
+	metric("full_rejections_total", "counter", "Entries refused because the cache was full.",
+		func(c CacheStats) string { return fmt.Sprint(c.FullRejections) })
+	metric("entries", "gauge", "Entries held in local memory.",
+		func(c CacheStats) string { return fmt.Sprint(c.Entries) })
+	metric("bytes", "gauge", "Approximate size of the entries held in local memory.",
+		func(c CacheStats) string { return fmt.Sprint(c.Bytes) })
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a nameserver reached over an encrypted transport, given in
+// the nameserver lists as a URL, e.g. tls://9.9.9.9:853 or
+// https://dns.google/dns-query. Plain nameservers
+// are asked over the transport of the client instead.
+type Upstream interface {
+	Exchange(req *dns.Msg) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+// isUpstreamURL tells a nameserver URL from a plain address.
+func isUpstreamURL(s string) bool {
+	return strings.Contains(s, "://")
+}
+
+// NewUpstream returns the Upstream of a nameserver URL:
+//
+//	tls://host[:853][?name=server-name][&ca=file][&pin=spki-sha256]...
+//	https://host[:443]/path[?ca=file][&pin=spki-sha256]...[&bootstrap=ip,...][&method=get]
+//
+// name is the TLS server name, host by default. ca verifies the server
+// certificate against the CAs of file instead of the system ones. pin, which
+// may be repeated, is the base64 SHA-256 of the server public key
+// (SubjectPublicKeyInfo); unless ca is also given, the certificate chain
+// isn't checked then, only the key. bootstrap are addresses to connect to
+// instead of resolving host. Other parameters are left in the URL.
+func NewUpstream(s string, timeout time.Duration) (Upstream, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tls":
+		return newTLSUpstream(u, timeout)
+	case "https":
+		return newHTTPSUpstream(u, timeout)
+	}
+	return nil, fmt.Errorf("unsupported nameserver scheme %s", u.Scheme)
+}
+
+// upstreamTLSConfig builds the TLS configuration of the name, ca and pin
+// parameters of u.
+func upstreamTLSConfig(u *url.URL) (*tls.Config, error) {
+	q := u.Query()
+	config := &tls.Config{ServerName: q.Get("name")}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+
+	if file := q.Get("ca"); file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", file)
+		}
+	}
+
+	var pins [][]byte
+	for _, pin := range q["pin"] {
+		sum, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q", pin)
+		}
+		pins = append(pins, sum)
+	}
+	if len(pins) > 0 {
+		// Go checks the chain before the pins only against the system CAs, so
+		// the chain is checked here. Only the leaf is proven by the handshake:
+		// with a CA, the pin must be in a chain the CA vouches for; without
+		// one, it must be the leaf key itself.
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no server certificate")
+			}
+			if roots == nil {
+				return verifyPins(cs.PeerCertificates[:1], pins)
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			chains, err := cs.PeerCertificates[0].Verify(opts)
+			if err != nil {
+				return err
+			}
+			for _, chain := range chains {
+				if verifyPins(chain, pins) == nil {
+					return nil
+				}
+			}
+			return errPinMismatch
+		}
+	}
+	return config, nil
+}
+
+var errPinMismatch = errors.New("no pinned public key in the server certificates")
+
+// verifyPins checks that one of certs has one of the pinned public keys.
+func verifyPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+/*
+DNS over TLS (RFC 7858)
+*/
+
+// Connections kept open to a DNS over TLS upstream, between lookups.
+const tlsUpstreamIdleConns = 4
+
+type tlsUpstream struct {
+	addr    string
+	config  *tls.Config
+	timeout time.Duration
+	idle    chan *dns.Conn
+}
+
+func newTLSUpstream(u *url.URL, timeout time.Duration) (*tlsUpstream, error) {
+	config, err := upstreamTLSConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "853")
+	}
+	return &tlsUpstream{
+		addr:    addr,
+		config:  config,
+		timeout: timeout,
+		idle:    make(chan *dns.Conn, tlsUpstreamIdleConns),
+	}, nil
+}
+
+func (u *tlsUpstream) dial() (*dns.Conn, error) {
+	dialer := &net.Dialer{Timeout: u.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.addr, u.config)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// Exchange sends req over an idle connection if there is one, or a new one.
+// The server may have closed an idle connection since, in which case the
+// query is sent again over a new one; other errors, timeouts included, are
+// returned as they are.
+func (u *tlsUpstream) Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c := &dns.Client{Net: "tcp-tls", ReadTimeout: u.timeout, WriteTimeout: u.timeout}
+
+	select {
+	case conn := <-u.idle:
+		r, rtt, err := c.ExchangeWithConn(req, conn)
+		if err == nil {
+			u.release(conn)
+			return r, rtt, nil
+		}
+		conn.Close()
+		if !isClosedConn(err) {
+			return nil, 0, err
+		}
+	default:
+	}
+
+	conn, err := u.dial()
+	if err != nil {
+		return nil, 0, err
+	}
+	r, rtt, err := c.ExchangeWithConn(req, conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	u.release(conn)
+	return r, rtt, nil
+}
+
+// isClosedConn reports whether err means the peer closed the connection.
+func isClosedConn(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func (u *tlsUpstream) release(conn *dns.Conn) {
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+/*
+DNS over HTTPS (RFC 8484)
+*/
+
+const dnsMessageType = "application/dns-message"
+
+type httpsUpstream struct {
+	url    *url.URL
+	get    bool
+	client *http.Client
+}
+
+func newHTTPSUpstream(u *url.URL, timeout time.Duration) (*httpsUpstream, error) {
+	config, err := upstreamTLSConfig(u)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	var bootstrap []string
+	for _, addrs := range q["bootstrap"] {
+		for _, ip := range strings.Split(addrs, ",") {
+			if !isIP(ip) {
+				return nil, fmt.Errorf("invalid bootstrap address %q", ip)
+			}
+			bootstrap = append(bootstrap, ip)
+		}
+	}
+	var get bool
+	switch method := strings.ToLower(q.Get("method")); method {
+	case "", "post":
+	case "get":
+		get = true
+	default:
+		return nil, fmt.Errorf("invalid method %q", method)
+	}
+
+	// the remaining parameters belong to the server
+	for _, param := range []string{"name", "ca", "pin", "bootstrap", "method"} {
+		q.Del(param)
+	}
+	endpoint := *u
+	endpoint.RawQuery = q.Encode()
+
+	dialer := &net.Dialer{Timeout: timeout}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: timeout,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: tlsUpstreamIdleConns,
+		// a custom TLS configuration turns HTTP/2 off otherwise
+		ForceAttemptHTTP2: true,
+	}
+	if len(bootstrap) > 0 {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range bootstrap {
+				var conn net.Conn
+				conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		}
+	}
+
+	return &httpsUpstream{
+		url:    &endpoint,
+		get:    get,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// Exchange sends req as a POST, or a GET with the get method. The query
+// ID is sent as 0, which lets HTTP caches share responses.
+func (u *httpsUpstream) Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	q := req.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var hreq *http.Request
+	if u.get {
+		endpoint := *u.url
+		params := endpoint.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		endpoint.RawQuery = params.Encode()
+		hreq, err = http.NewRequest(http.MethodGet, endpoint.String(), nil)
+	} else {
+		hreq, err = http.NewRequest(http.MethodPost, u.url.String(), bytes.NewReader(buf))
+		if err == nil {
+			hreq.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	hreq.Header.Set("Accept", dnsMessageType)
+
+	start := time.Now()
+	hresp, err := u.client.Do(hreq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s answered %s", u.url.Host, hresp.Status)
+	}
+	if ct := hresp.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, 0, fmt.Errorf("%s answered with %q content", u.url.Host, ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	r.Id = req.Id
+	return r, rtt, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testCert is a self-signed certificate for dns.test and 127.0.0.1.
+type testCert struct {
+	tls     tls.Certificate
+	caFile  string // the certificate in PEM, to trust or serve it
+	keyFile string // the private key in PEM
+	pin     string // base64 SHA-256 of its public key
+}
+
+func newTestCert(t *testing.T) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(filepath.Dir(caFile), "key.pem")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return &testCert{
+		tls:     tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert},
+		caFile:  caFile,
+		keyFile: keyFile,
+		pin:     base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+// countingListener counts the connections it accepted.
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return c, err
+}
+
+// newTestTLSUpstream serves handler over DNS over TLS with cert.
+func newTestTLSUpstream(t *testing.T, cert *testCert, handler dns.HandlerFunc) (*countingListener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	config := &tls.Config{Certificates: []tls.Certificate{cert.tls}}
+	srv := &dns.Server{Listener: tls.NewListener(cl, config), Net: "tcp-tls", Handler: handler}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return cl, l.Addr().String()
+}
+
+func TestTLSUpstream(t *testing.T) {
+	cert := newTestCert(t)
+	other := newTestCert(t)
+	var queries int64
+	l, addr := newTestTLSUpstream(t, cert, answerA(60, &queries))
+
+	exchange := func(spec string) (*dns.Msg, error) {
+		u, err := NewUpstream(spec, 2*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		r, _, err := u.Exchange(req)
+		return r, err
+	}
+
+	Convey("DNS over TLS upstreams", t, func() {
+		Convey("Should trust the server of a CA file", func() {
+			r, err := exchange("tls://" + addr + "?name=dns.test&ca=" + url.QueryEscape(cert.caFile))
+			So(err, ShouldBeNil)
+			So(r.Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("Should refuse a server the CA file didn't sign", func() {
+			_, err := exchange("tls://" + addr + "?name=dns.test&ca=" + url.QueryEscape(other.caFile))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should refuse a server name not in the certificate", func() {
+			_, err := exchange("tls://" + addr + "?name=other.test&ca=" + url.QueryEscape(cert.caFile))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should trust a pinned public key", func() {
+			r, err := exchange("tls://" + addr + "?pin=" + url.QueryEscape(other.pin) + "&pin=" + url.QueryEscape(cert.pin))
+			So(err, ShouldBeNil)
+			So(r.Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("Should refuse a key that isn't pinned", func() {
+			_, err := exchange("tls://" + addr + "?pin=" + url.QueryEscape(other.pin))
+			So(err, ShouldNotBeNil)
+			_, err = exchange("tls://" + addr + "?name=dns.test&ca=" + url.QueryEscape(cert.caFile) + "&pin=" + url.QueryEscape(other.pin))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should refuse a pinned certificate appended to another key's", func() {
+			// the attacker holds the key of the leaf only; the pinned
+			// certificate is public
+			forged := *other
+			forged.tls.Certificate = [][]byte{other.tls.Certificate[0], cert.tls.Certificate[0]}
+			_, forgedAddr := newTestTLSUpstream(t, &forged, answerA(60, &queries))
+			_, err := exchange("tls://" + forgedAddr + "?pin=" + url.QueryEscape(cert.pin))
+			So(err, ShouldNotBeNil)
+			_, err = exchange("tls://" + forgedAddr + "?name=dns.test&ca=" + url.QueryEscape(other.caFile) + "&pin=" + url.QueryEscape(cert.pin))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should reject invalid nameserver URLs", func() {
+			_, err := NewUpstream("tls://"+addr+"?pin=short", time.Second)
+			So(err, ShouldNotBeNil)
+			_, err = NewUpstream("tls://"+addr+"?ca=/nonexistent", time.Second)
+			So(err, ShouldNotBeNil)
+			_, err = NewUpstream("quic://"+addr, time.Second)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should reuse its connections", func() {
+			u, err := NewUpstream("tls://"+addr+"?pin="+url.QueryEscape(cert.pin), 2*time.Second)
+			So(err, ShouldBeNil)
+			before := atomic.LoadInt64(&l.accepted)
+			for i := 0; i < 5; i++ {
+				req := new(dns.Msg)
+				req.SetQuestion("www.example.com.", dns.TypeA)
+				_, _, err := u.Exchange(req)
+				So(err, ShouldBeNil)
+			}
+			So(atomic.LoadInt64(&l.accepted)-before, ShouldEqual, 1)
+		})
+
+		Convey("Should redial an idle connection the server closed", func() {
+			closing, closingAddr := newTestTLSUpstream(t, cert, func(w dns.ResponseWriter, req *dns.Msg) {
+				answerA(60, &queries)(w, req)
+				w.Close()
+			})
+			u, err := NewUpstream("tls://"+closingAddr+"?pin="+url.QueryEscape(cert.pin), 2*time.Second)
+			So(err, ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				req := new(dns.Msg)
+				req.SetQuestion("www.example.com.", dns.TypeA)
+				_, _, err := u.Exchange(req)
+				So(err, ShouldBeNil)
+			}
+			So(atomic.LoadInt64(&closing.accepted), ShouldEqual, 3)
+		})
+
+		Convey("Should not send a timed out query again", func() {
+			var slow int32
+			slowL, slowAddr := newTestTLSUpstream(t, cert, func(w dns.ResponseWriter, req *dns.Msg) {
+				if atomic.LoadInt32(&slow) == 1 {
+					time.Sleep(time.Second)
+				}
+				answerA(60, &queries)(w, req)
+			})
+			u, err := NewUpstream("tls://"+slowAddr+"?pin="+url.QueryEscape(cert.pin), 300*time.Millisecond)
+			So(err, ShouldBeNil)
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			_, _, err = u.Exchange(req)
+			So(err, ShouldBeNil)
+
+			atomic.StoreInt32(&slow, 1)
+			start := time.Now()
+			_, _, err = u.Exchange(req)
+			So(err, ShouldNotBeNil)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+			So(atomic.LoadInt64(&slowL.accepted), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestResolverTLSUpstream(t *testing.T) {
+	if logger == nil {
+		logger = NewLogger()
+	}
+	cert := newTestCert(t)
+	var queries int64
+	_, addr := newTestTLSUpstream(t, cert, answerA(60, &queries))
+	spec := "tls://" + addr + "?pin=" + url.QueryEscape(cert.pin)
+
+	Convey("Resolver with DNS over TLS nameservers", t, func() {
+		Convey("Should resolve over [resolv] servers", func() {
+			r := NewResolver(ResolvSettings{Timeout: 2, Servers: []string{spec}})
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			resp, err := r.Lookup("udp", req)
+			So(err, ShouldBeNil)
+			So(resp.Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("Should read them from server list files", func() {
+			file := filepath.Join(t.TempDir(), "servers.conf")
+			list := "server=/example.com/" + spec + "\nserver=tls://9.9.9.9?name=dns.quad9.net\n"
+			So(ioutil.WriteFile(file, []byte(list), 0644), ShouldBeNil)
+
+			r := NewResolver(ResolvSettings{Timeout: 2, ServerListFile: file})
+			So(r.Nameservers("www.example.com."), ShouldResemble, []string{spec})
+			So(r.Nameservers("www.example.org."), ShouldResemble, []string{"tls://9.9.9.9?name=dns.quad9.net"})
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			resp, err := r.Lookup("udp", req)
+			So(err, ShouldBeNil)
+			So(resp.Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("Should refuse to start with an invalid one", func() {
+			So(func() {
+				NewResolver(ResolvSettings{Timeout: 2, Servers: []string{"tls://" + addr + "?pin=short"}})
+			}, ShouldPanic)
+		})
+	})
+}
+
+// dohRequest is what the DoH stand-in saw of a query.
+type dohRequest struct {
+	method, proto string
+	id            uint16
+	params        url.Values
+}
+
+// newTestDoHServer serves RFC 8484 queries over HTTP/2 with cert, answering
+// them with a single A record, and reports them on requests.
+func newTestDoHServer(t *testing.T, cert *testCert, requests chan<- dohRequest) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" {
+			http.NotFound(w, r)
+			return
+		}
+		var buf []byte
+		var err error
+		if r.Method == http.MethodGet {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			buf, err = ioutil.ReadAll(r.Body)
+		}
+		req := new(dns.Msg)
+		if err == nil {
+			err = req.Unpack(buf)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case requests <- dohRequest{r.Method, r.Proto, req.Id, r.URL.Query()}:
+		default:
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert.tls}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTPSUpstream(t *testing.T) {
+	cert := newTestCert(t)
+	requests := make(chan dohRequest, 16)
+	srv := newTestDoHServer(t, cert, requests)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	// dns.test only resolves through the bootstrap address
+	endpoint := "https://dns.test:" + port + "/dns-query?bootstrap=127.0.0.1&ca=" + url.QueryEscape(cert.caFile)
+
+	exchange := func(spec string) (*dns.Msg, error) {
+		u, err := NewUpstream(spec, 2*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.Id = 4242
+		r, _, err := u.Exchange(req)
+		return r, err
+	}
+
+	Convey("DNS over HTTPS upstreams", t, func() {
+		Convey("Should POST queries over HTTP/2", func() {
+			r, err := exchange(endpoint)
+			So(err, ShouldBeNil)
+			So(r.Id, ShouldEqual, 4242)
+			So(r.Answer, ShouldHaveLength, 1)
+
+			seen := <-requests
+			So(seen.method, ShouldEqual, http.MethodPost)
+			So(seen.proto, ShouldEqual, "HTTP/2.0")
+			So(seen.id, ShouldEqual, 0)
+			So(seen.params, ShouldBeEmpty)
+		})
+
+		Convey("Should GET queries with the get method", func() {
+			r, err := exchange(endpoint + "&method=get&tenant=a")
+			So(err, ShouldBeNil)
+			So(r.Id, ShouldEqual, 4242)
+
+			seen := <-requests
+			So(seen.method, ShouldEqual, http.MethodGet)
+			So(seen.params.Get("tenant"), ShouldEqual, "a")
+			So(seen.params.Get("bootstrap"), ShouldEqual, "")
+		})
+
+		Convey("Should check the server certificate", func() {
+			_, err := exchange("https://dns.test:" + port + "/dns-query?bootstrap=127.0.0.1&pin=" + url.QueryEscape(newTestCert(t).pin))
+			So(err, ShouldNotBeNil)
+			_, err = exchange("https://dns.test:" + port + "/dns-query?bootstrap=127.0.0.1&pin=" + url.QueryEscape(cert.pin))
+			So(err, ShouldBeNil)
+			<-requests
+		})
+
+		Convey("Should fail on HTTP errors", func() {
+			_, err := exchange(strings.Replace(endpoint, "/dns-query", "/missing", 1))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should reject invalid options", func() {
+			_, err := NewUpstream(endpoint+"&bootstrap=dns.google", time.Second)
+			So(err, ShouldNotBeNil)
+			_, err = NewUpstream(endpoint+"&method=put", time.Second)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Should be raced like the other nameservers", func() {
+			if logger == nil {
+				logger = NewLogger()
+			}
+			r := NewResolver(ResolvSettings{Timeout: 2, Servers: []string{"127.0.0.1:1", endpoint}})
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.com.", dns.TypeA)
+			resp, err := r.Lookup("udp", req)
+			So(err, ShouldBeNil)
+			So(resp.Answer, ShouldHaveLength, 1)
+			<-requests
+		})
+	})
+}
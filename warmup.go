@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// readWarmupFile reads the questions of a warm-up file: one name per line,
+// optionally followed by query types, A if there are none.
+//
+//	# comment
+//	www.example.com
+//	example.com A AAAA MX
+func readWarmupFile(file string) ([]dns.Question, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var questions []dns.Question
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := fields[0]
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("%s:%d: invalid name %q", file, n, name)
+		}
+		qtypes := fields[1:]
+		if len(qtypes) == 0 {
+			qtypes = []string{"A"}
+		}
+		for _, t := range qtypes {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: invalid type %q", file, n, t)
+			}
+			questions = append(questions, dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET})
+		}
+	}
+	return questions, scanner.Err()
+}
+
+// Warmup resolves questions, at most concurrency at a time, to populate the
+// cache. It returns how many of them were resolved.
+func (h *GODNSHandler) Warmup(questions []dns.Question, concurrency int) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var resolved int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, q := range questions {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(q dns.Question) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			req := new(dns.Msg)
+			req.SetQuestion(q.Name, q.Qtype)
+			Q := Question{UnFqdn(q.Name), dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass]}
+			if _, err := h.lookup("udp", req, h.ecs.RequestKey(Q, req), Q); err != nil {
+				logger.Warn("Warm up %s failed: %s", Q.String(), err)
+				return
+			}
+			atomic.AddInt64(&resolved, 1)
+		}(q)
+	}
+	wg.Wait()
+	return int(resolved)
+}
+
+// WarmupFromFile resolves the questions listed in file, see readWarmupFile.
+func (h *GODNSHandler) WarmupFromFile(file string, concurrency int) {
+	questions, err := readWarmupFile(file)
+	if err != nil {
+		logger.Error("Read warm-up file %s failed: %s", file, err)
+		return
+	}
+
+	start := time.Now()
+	n := h.Warmup(questions, concurrency)
+	logger.Info("Warm up %d of %d questions from %s in %v", n, len(questions), file, time.Since(start))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWarmup(t *testing.T) {
+	Convey("Warm-up should resolve the listed names into the cache", t, func() {
+		dir, _ := ioutil.TempDir("", "godns")
+		defer os.RemoveAll(dir)
+		file := filepath.Join(dir, "warmup")
+		ioutil.WriteFile(file, []byte("# services\nwww.example.com\napi.example.com A aaaa\n\n"), 0644)
+
+		questions, err := readWarmupFile(file)
+		So(err, ShouldBeNil)
+		So(len(questions), ShouldEqual, 3)
+		So(questions[2].Name, ShouldEqual, "api.example.com.")
+		So(questions[2].Qtype, ShouldEqual, dns.TypeAAAA)
+
+		var queries int64
+		upstream, addr := newTestUpstream(t, answerA(300, &queries))
+		defer upstream.Shutdown()
+		h := newTestHandler(addr)
+
+		So(h.Warmup(questions, 2), ShouldEqual, 3)
+		So(atomic.LoadInt64(&queries), ShouldEqual, 3)
+		So(h.cache.Exists(KeyGen(Question{"www.example.com", "A", "IN"}, "")), ShouldEqual, true)
+
+		Convey("Invalid lines should be reported", func() {
+			ioutil.WriteFile(file, []byte("www.example.com BOGUS\n"), 0644)
+			_, err := readWarmupFile(file)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}